@@ -0,0 +1,192 @@
+package driver
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	aclActionAllow = "allow"
+	aclActionDeny  = "deny"
+	aclMatchAll    = "all"
+
+	// ACL rules take a band of tc priorities on the representor ingress
+	// from aclTcPrioBase, above the low priorities OVS hw-offload and
+	// other users allocate from 1, and the handle of their position, so
+	// that only they are deleted. Filters at lower priorities are
+	// evaluated first.
+	aclTcPrioBase   = 0xf000
+	aclTcMaxRules   = 0xffff - aclTcPrioBase
+	aclTcHandleBase = 1
+)
+
+type aclRule struct {
+	action string
+	proto  string
+	src    string
+	dst    string
+	sport  int
+	dport  int
+}
+
+func parseAclPort(value string) (int, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("Invalid acl port %s", value)
+	}
+	return port, nil
+}
+
+func parseAclPrefix(value string) (string, error) {
+	if !strings.Contains(value, "/") {
+		value = value + "/32"
+	}
+	_, ipNet, err := net.ParseCIDR(value)
+	if err != nil || ipNet.IP.To4() == nil {
+		return "", fmt.Errorf("Invalid acl prefix %s", value)
+	}
+	return ipNet.String(), nil
+}
+
+// parseAcl parses a network ACL of ';' separated rules, each made of an
+// allow/deny action followed by proto=, src=, dst=, sport=, dport= matches
+// or by "all". Rules are evaluated in the given order.
+func parseAcl(acl string) ([]aclRule, error) {
+	var rules []aclRule
+	var err error
+
+	for _, ruleStr := range strings.Split(acl, ";") {
+		fields := strings.Fields(ruleStr)
+		if len(fields) == 0 {
+			continue
+		}
+		rule := aclRule{action: fields[0]}
+		if rule.action != aclActionAllow && rule.action != aclActionDeny {
+			return nil, fmt.Errorf("Invalid acl action %s, valid actions are: allow and deny", fields[0])
+		}
+		if len(fields) == 1 {
+			return nil, fmt.Errorf("acl rule %s has no match", ruleStr)
+		}
+
+		for _, match := range fields[1:] {
+			if match == aclMatchAll {
+				continue
+			}
+			kv := strings.SplitN(match, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("Invalid acl match %s", match)
+			}
+			switch kv[0] {
+			case "proto":
+				if kv[1] != "tcp" && kv[1] != "udp" && kv[1] != "icmp" {
+					return nil, fmt.Errorf("Invalid acl proto %s, valid protos are: tcp, udp and icmp", kv[1])
+				}
+				rule.proto = kv[1]
+			case "src":
+				rule.src, err = parseAclPrefix(kv[1])
+			case "dst":
+				rule.dst, err = parseAclPrefix(kv[1])
+			case "sport":
+				rule.sport, err = parseAclPort(kv[1])
+			case "dport":
+				rule.dport, err = parseAclPort(kv[1])
+			default:
+				return nil, fmt.Errorf("Invalid acl match %s", kv[0])
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		if (rule.sport != 0 || rule.dport != 0) && rule.proto != "tcp" && rule.proto != "udp" {
+			return nil, fmt.Errorf("acl port match requires proto tcp or udp")
+		}
+		rules = append(rules, rule)
+	}
+	if len(rules) > aclTcMaxRules {
+		return nil, fmt.Errorf("acl has %d rules, at most %d are supported", len(rules), aclTcMaxRules)
+	}
+	return rules, nil
+}
+
+// aclTcFilterId returns the tc priority and handle of an ACL rule.
+func aclTcFilterId(pos int) []string {
+	return []string{"prio", strconv.Itoa(aclTcPrioBase + pos),
+		"handle", strconv.Itoa(aclTcHandleBase + pos)}
+}
+
+func (rule *aclRule) flowerArgs() []string {
+	args := []string{"flower"}
+
+	if rule.proto != "" {
+		args = append(args, "ip_proto", rule.proto)
+	}
+	if rule.src != "" {
+		args = append(args, "src_ip", rule.src)
+	}
+	if rule.dst != "" {
+		args = append(args, "dst_ip", rule.dst)
+	}
+	if rule.sport != 0 {
+		args = append(args, "src_port", strconv.Itoa(rule.sport))
+	}
+	if rule.dport != 0 {
+		args = append(args, "dst_port", strconv.Itoa(rule.dport))
+	}
+	if rule.action == aclActionAllow {
+		return append(args, "action", "pass")
+	}
+	return append(args, "action", "drop")
+}
+
+// ensureIngressQdisc adds an ingress qdisc to the VF representor unless
+// it already has one, possibly added by another user such as OVS.
+func ensureIngressQdisc(repName string) error {
+	out, err := exec.Command("tc", "qdisc", "show", "dev", repName).Output()
+	if err != nil {
+		return fmt.Errorf("Fail to show qdiscs of %s: %v", repName, err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "qdisc ingress") || strings.HasPrefix(line, "qdisc clsact") {
+			return nil
+		}
+	}
+	return runCommand("tc", "qdisc", "add", "dev", repName, "ingress")
+}
+
+// applyAcl installs the network ACL as tc flower rules on the ingress of
+// the VF representor, which sees all traffic sent by the VF.
+func applyAcl(repName string, rules []aclRule) error {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	removeAcl(repName, len(rules))
+	err := ensureIngressQdisc(repName)
+	if err != nil {
+		return err
+	}
+
+	for i := range rules {
+		args := append([]string{"filter", "add", "dev", repName, "ingress"}, aclTcFilterId(i)...)
+		args = append(args, "protocol", "ip")
+		args = append(args, rules[i].flowerArgs()...)
+		err = runCommand("tc", args...)
+		if err != nil {
+			removeAcl(repName, i)
+			return err
+		}
+	}
+	return nil
+}
+
+// removeAcl deletes the ACL rules of the VF representor by their handle.
+// The ingress qdisc and filters of others are kept.
+func removeAcl(repName string, numRules int) {
+	for i := 0; i < numRules; i++ {
+		args := append([]string{"filter", "del", "dev", repName, "ingress"}, aclTcFilterId(i)...)
+		runCommand("tc", append(args, "protocol", "ip", "flower")...)
+	}
+}
@@ -0,0 +1,175 @@
+package driver
+
+import (
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"log"
+	"net"
+)
+
+const (
+	bondModeActiveBackup = "active-backup"
+	bondModeLACP         = "802.3ad"
+	bondNamePrefix       = "bond"
+	bondMiimon           = 100
+)
+
+var bondModes = map[string]netlink.BondMode{
+	bondModeActiveBackup: netlink.BOND_MODE_ACTIVE_BACKUP,
+	bondModeLACP:         netlink.BOND_MODE_802_3AD,
+}
+
+func parseBondMode(value string) (netlink.BondMode, error) {
+	mode, ok := bondModes[value]
+	if !ok {
+		return 0, fmt.Errorf("valid bond modes are: %s and %s", bondModeActiveBackup, bondModeLACP)
+	}
+	return mode, nil
+}
+
+// endpointBondName returns the name of the bond of an endpoint. It is
+// unique among endpoints, so that docker can move the bond back to the
+// host when the container stops even if another bond was created meanwhile.
+func endpointBondName(endpointID string) string {
+	return fmt.Sprintf("%s%.7s", bondNamePrefix, endpointID)
+}
+
+// createBond creates a bond of the slaves in the host network namespace,
+// which docker moves into the container like any other endpoint netdevice.
+func createBond(name string, slaves []string, mode netlink.BondMode, hwAddr string) error {
+	var err error
+
+	bond := netlink.NewLinkBond(netlink.NewLinkAttrs())
+	bond.Name = name
+	bond.Mode = mode
+	bond.Miimon = bondMiimon
+	if hwAddr != "" {
+		bond.HardwareAddr, err = net.ParseMAC(hwAddr)
+		if err != nil {
+			return err
+		}
+	}
+	err = netlink.LinkAdd(bond)
+	if err != nil {
+		return fmt.Errorf("Fail to create bond %s: %v", name, err)
+	}
+
+	for _, slave := range slaves {
+		link, err := netlink.LinkByName(slave)
+		if err == nil {
+			// slaves have to be down to be enslaved
+			netlink.LinkSetDown(link)
+			err = netlink.LinkSetBondSlave(link, bond)
+		}
+		if err != nil {
+			netlink.LinkDel(bond)
+			return fmt.Errorf("Fail to enslave %s to %s: %v", slave, name, err)
+		}
+	}
+	return nil
+}
+
+// deleteBond deletes a bond, which releases its slaves.
+func deleteBond(name string) {
+	link, err := netlink.LinkByName(name)
+	if err == nil {
+		err = netlink.LinkDel(link)
+	}
+	if err != nil {
+		log.Printf("Fail to delete bond %s: %v\n", name, err)
+	}
+}
+
+// linkState is the configuration of a netdevice which bonding or moving
+// across network namespaces loses.
+type linkState struct {
+	name   string
+	up     bool
+	mtu    int
+	hwAddr net.HardwareAddr
+	addrs  []netlink.Addr
+}
+
+func saveLinkState(netdevName string) (*linkState, error) {
+	link, err := netlink.LinkByName(netdevName)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+	state := &linkState{
+		name:   netdevName,
+		up:     link.Attrs().Flags&net.FlagUp != 0,
+		mtu:    link.Attrs().MTU,
+		hwAddr: link.Attrs().HardwareAddr,
+	}
+	for _, addr := range addrs {
+		/* kernel generates IPv6 link-local addresses again on link up */
+		if addr.IP.To4() == nil && addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		state.addrs = append(state.addrs, addr)
+	}
+	return state, nil
+}
+
+func (state *linkState) toDb() DB_Link_State {
+	dbState := DB_Link_State{
+		Name:      state.name,
+		Up:        state.up,
+		Mtu:       state.mtu,
+		HwAddress: state.hwAddr.String(),
+	}
+	for _, addr := range state.addrs {
+		dbState.Addresses = append(dbState.Addresses, addr.IPNet.String())
+	}
+	return dbState
+}
+
+func linkStateFromDb(dbState *DB_Link_State) (*linkState, error) {
+	hwAddr, err := net.ParseMAC(dbState.HwAddress)
+	if err != nil {
+		return nil, err
+	}
+	state := &linkState{
+		name:   dbState.Name,
+		up:     dbState.Up,
+		mtu:    dbState.Mtu,
+		hwAddr: hwAddr,
+	}
+	for _, value := range dbState.Addresses {
+		addr, err := netlink.ParseAddr(value)
+		if err != nil {
+			return nil, err
+		}
+		state.addrs = append(state.addrs, *addr)
+	}
+	return state, nil
+}
+
+func (state *linkState) restore() error {
+	link, err := netlink.LinkByName(state.name)
+	if err != nil {
+		return err
+	}
+	err = netlink.LinkSetMTU(link, state.mtu)
+	if err != nil {
+		return err
+	}
+	err = netlink.LinkSetHardwareAddr(link, state.hwAddr)
+	if err != nil {
+		return err
+	}
+	for i := range state.addrs {
+		err = netlink.AddrAdd(link, &state.addrs[i])
+		if err != nil {
+			log.Printf("Fail to restore address %v of %s: %v\n", state.addrs[i].IPNet, state.name, err)
+		}
+	}
+	if state.up {
+		return netlink.LinkSetUp(link)
+	}
+	return nil
+}
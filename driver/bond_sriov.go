@@ -0,0 +1,248 @@
+package driver
+
+import (
+	"fmt"
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/vishvananda/netlink"
+	"log"
+	"net"
+	"strings"
+)
+
+const (
+	bondPfCount = 2
+)
+
+// bondSriovNetwork gives each container a bond of one VF of each of two
+// PFs, for link redundancy. The VFs of a PF are managed by an sriovNetwork
+// of that PF.
+type bondSriovNetwork struct {
+	genNw    *genericNetwork
+	slaves   []*sriovNetwork // one per PF
+	bondMode netlink.BondMode
+	vfLag    bool // PFs are in hardware VF LAG, a single VF is redundant
+}
+
+// pfNetworkID is the id of the network of a single PF of a network with
+// several PFs.
+func pfNetworkID(nid string, pfNetdevName string) string {
+	return nid + "/" + pfNetdevName
+}
+
+// checkVfLag tells whether the PFs are ports of a VF LAG, which the NIC
+// offloads once the PFs are in switchdev mode and bonded together in the
+// host.
+func checkVfLag(pfNetdevNames []string) bool {
+	var master int
+
+	for _, pfNetdevName := range pfNetdevNames {
+		dev := pfDevices[pfNetdevName]
+		if dev == nil || dev.cfg.Eswitch != eswitchModeSwitchdev {
+			return false
+		}
+		link, err := netlink.LinkByName(pfNetdevName)
+		if err != nil || link.Attrs().MasterIndex == 0 {
+			return false
+		}
+		if master != 0 && link.Attrs().MasterIndex != master {
+			return false
+		}
+		master = link.Attrs().MasterIndex
+	}
+	masterLink, err := netlink.LinkByIndex(master)
+	return err == nil && masterLink.Type() == "bond"
+}
+
+func (nw *bondSriovNetwork) getGenNw() *genericNetwork {
+	return nw.genNw
+}
+
+func (nw *bondSriovNetwork) CreateNetwork(d *driver, genNw *genericNetwork,
+	nid string, options map[string]string,
+	ipv4Data *network.IPAMData) error {
+	var err error
+
+	pfNetdevNames := strings.Split(options[networkDevice], ",")
+	if len(pfNetdevNames) != bondPfCount || pfNetdevNames[0] == pfNetdevNames[1] {
+		return fmt.Errorf("bond requires two PF netdevices")
+	}
+	nw.bondMode, err = parseBondMode(options[networkBond])
+	if err != nil {
+		return err
+	}
+	nw.genNw = genNw
+
+	for _, pfNetdevName := range pfNetdevNames {
+		if checkMultiPortDevice(pfNetdevName) {
+			err = fmt.Errorf("bond is not supported on multiport device %s", pfNetdevName)
+			break
+		}
+
+		slaveOptions := make(map[string]string)
+		for k, v := range options {
+			slaveOptions[k] = v
+		}
+		slaveOptions[networkDevice] = pfNetdevName
+
+		slaveID := pfNetworkID(nid, pfNetdevName)
+		slaveGenNw := createGenNw(slaveID, pfNetdevName, genNw.mode, genNw.ethPrefix, ipv4Data)
+		slaveGenNw.driver = d
+		slaveGenNw.rdmaTuning = genNw.rdmaTuning
+
+		slave := &sriovNetwork{}
+		err = slave.CreateNetwork(d, slaveGenNw, slaveID, slaveOptions, ipv4Data)
+		if err != nil {
+			err = fmt.Errorf("%s: %v", pfNetdevName, err)
+			break
+		}
+		nw.slaves = append(nw.slaves, slave)
+	}
+	if err == nil {
+		nw.vfLag = checkVfLag(pfNetdevNames)
+		if !nw.vfLag && genNw.rdmaNetns != "" {
+			err = fmt.Errorf("rdma_netns requires VF LAG in bond networks")
+		}
+	}
+	if err != nil {
+		nw.DeleteNetwork(d, &network.DeleteNetworkRequest{NetworkID: nid})
+		return err
+	}
+
+	log.Printf("Bond CreateNetwork : [%s] vf lag: %v IPv4Data : [ %+v ]\n",
+		nw.genNw.id, nw.vfLag, nw.genNw.IPv4Data)
+	return nil
+}
+
+func (nw *bondSriovNetwork) DeleteNetwork(d *driver, req *network.DeleteNetworkRequest) {
+	for _, slave := range nw.slaves {
+		slave.DeleteNetwork(d, &network.DeleteNetworkRequest{NetworkID: slave.genNw.id})
+	}
+	nw.slaves = nil
+}
+
+// setSlavesHwAddr gives the VFs of a bond the MAC address of the bond, so
+// that spoof check lets the active slave use it.
+func setSlavesHwAddr(nw *bondSriovNetwork, endpoint *ptEndpoint) error {
+	hwAddr, err := net.ParseMAC(endpoint.HardwareAddr)
+	if err != nil {
+		return err
+	}
+	for i, slaveEp := range endpoint.slaves {
+		pfLink, err := netlink.LinkByName(nw.slaves[i].genNw.ndevName)
+		if err != nil {
+			return err
+		}
+		err = netlink.LinkSetVfHardwareAddr(pfLink, slaveEp.vfObj.Index, hwAddr)
+		if err != nil {
+			return fmt.Errorf("Fail to set mac address of vf %d: %v", slaveEp.vfObj.Index, err)
+		}
+	}
+	return nil
+}
+
+func (nw *bondSriovNetwork) CreateEndpoint(r *network.CreateEndpointRequest) (*network.CreateEndpointResponse, error) {
+	var err error
+
+	ndev := &ptEndpoint{
+		id:           r.EndpointID,
+		HardwareAddr: r.Interface.MacAddress,
+		Address:      r.Interface.Address,
+	}
+
+	if nw.vfLag {
+		// VFs of the first PF are backed by both ports in hardware, so
+		// the VF is given to the container as in sriov mode.
+		_, err = nw.slaves[0].CreateEndpoint(r)
+		if err != nil {
+			return nil, err
+		}
+		slaveEp := nw.slaves[0].genNw.ndevEndpoints[r.EndpointID]
+		ndev.slaves = append(ndev.slaves, slaveEp)
+		ndev.devName = slaveEp.devName
+		ndev.vfObj = slaveEp.vfObj
+	} else {
+		// VFs are picked by the bond network, the MAC address is set
+		// once both are allocated. The bond of the VFs is given to the
+		// container.
+		slaveIface := *r.Interface
+		slaveIface.MacAddress = ""
+		slaveReq := *r
+		slaveReq.Interface = &slaveIface
+
+		for _, slave := range nw.slaves {
+			_, err = slave.CreateEndpoint(&slaveReq)
+			if err != nil {
+				nw.DeleteEndpoint(ndev)
+				return nil, fmt.Errorf("%s: %v", slave.genNw.ndevName, err)
+			}
+			ndev.slaves = append(ndev.slaves, slave.genNw.ndevEndpoints[r.EndpointID])
+		}
+		if ndev.HardwareAddr == "" {
+			ndev.HardwareAddr, err = GetVFDefaultMacAddr(ndev.slaves[0].devName)
+		}
+		if err == nil {
+			err = setSlavesHwAddr(nw, ndev)
+		}
+		if err == nil {
+			var slaveNames []string
+			for _, slaveEp := range ndev.slaves {
+				slaveNames = append(slaveNames, slaveEp.devName)
+			}
+			bondName := endpointBondName(r.EndpointID)
+			err = createBond(bondName, slaveNames, nw.bondMode, ndev.HardwareAddr)
+			if err == nil {
+				ndev.devName = bondName
+			}
+		}
+		if err != nil {
+			nw.DeleteEndpoint(ndev)
+			return nil, err
+		}
+	}
+	nw.genNw.ndevEndpoints[r.EndpointID] = ndev
+
+	resp := &network.CreateEndpointResponse{Interface: &network.EndpointInterface{}}
+	log.Printf("Bond CreateEndpoint [ %s ] slaves: %d\n", r.EndpointID, len(ndev.slaves))
+	return resp, nil
+}
+
+func (nw *bondSriovNetwork) DeleteEndpoint(endpoint *ptEndpoint) {
+	if !nw.vfLag && endpoint.devName != "" {
+		deleteBond(endpoint.devName)
+	}
+	for i, slaveEp := range endpoint.slaves {
+		nw.slaves[i].DeleteEndpoint(slaveEp)
+		delete(nw.slaves[i].genNw.ndevEndpoints, endpoint.id)
+	}
+	endpoint.slaves = nil
+}
+
+// RestoreEndpoint takes over the VFs of an endpoint created before the
+// plugin restarted.
+func (nw *bondSriovNetwork) RestoreEndpoint(id string, dbEp *DB_Endpoint) error {
+
+	endpoint := &ptEndpoint{
+		id:           id,
+		HardwareAddr: dbEp.HwAddress,
+		devName:      dbEp.DevName,
+		Address:      dbEp.Address,
+	}
+	for i := range dbEp.Slaves {
+		var err error
+		if i >= len(nw.slaves) {
+			err = fmt.Errorf("endpoint has more slaves than PFs of the network")
+		} else {
+			err = nw.slaves[i].RestoreEndpoint(id, &dbEp.Slaves[i])
+		}
+		if err != nil {
+			nw.DeleteEndpoint(endpoint)
+			return err
+		}
+		endpoint.slaves = append(endpoint.slaves, nw.slaves[i].genNw.ndevEndpoints[id])
+	}
+	if nw.vfLag && len(endpoint.slaves) > 0 {
+		endpoint.vfObj = endpoint.slaves[0].vfObj
+	}
+	nw.genNw.ndevEndpoints[id] = endpoint
+	return nil
+}
@@ -2,11 +2,26 @@ package driver
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
+	"io/ioutil"
+	"path/filepath"
+	"time"
 )
 
+const (
+	dockerApiTimeout = 5 * time.Second
+)
+
+/* cpuset of a container, as in its hostconfig.json */
+type containerCpuset struct {
+	CpusetCpus string `json:"CpusetCpus"`
+	CpusetMems string `json:"CpusetMems"`
+}
+
 func getRightClientApiVersion() (string, error) {
 	// Start with the lowest API to query which version is supported.
 	lowestCli, err3 := client.NewClientWithOpts(client.FromEnv, client.WithVersion("1.12"))
@@ -55,3 +70,58 @@ func IsNetworkIdValid(id string) bool {
 	}
 	return false
 }
+
+// startingContainerCpusets returns the cpusets of the containers which may
+// be starting on a network: the ones which are not running and have no
+// endpoint on it yet. dockerd holds the lock of a starting container while
+// it creates its endpoints, so containers are not inspected, their cpuset
+// is read from their hostconfig.json in the docker root directory instead.
+func startingContainerCpusets(networkID string) ([]containerCpuset, error) {
+	var cpusets []containerCpuset
+
+	ctx, cancel := context.WithTimeout(context.Background(), dockerApiTimeout)
+	defer cancel()
+
+	cli, err := getRightClient()
+	if err != nil {
+		return nil, err
+	}
+	info, err := cli.Info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("network", networkID)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, ctr := range containers {
+		if ctr.State == "running" || ctr.State == "paused" || ctr.NetworkSettings == nil {
+			continue
+		}
+		joined := false
+		for _, ep := range ctr.NetworkSettings.Networks {
+			if ep != nil && ep.NetworkID == networkID && ep.EndpointID != "" {
+				joined = true
+			}
+		}
+		if joined {
+			continue
+		}
+
+		cpuset := containerCpuset{}
+		rawData, err := ioutil.ReadFile(filepath.Join(info.DockerRootDir,
+			"containers", ctr.ID, "hostconfig.json"))
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(rawData, &cpuset)
+		if err != nil {
+			return nil, err
+		}
+		cpusets = append(cpusets, cpuset)
+	}
+	return cpusets, nil
+}
@@ -0,0 +1,86 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+const (
+	DefaultConfigFile = "/etc/docker/mellanox/docker-sriov-plugin.json"
+)
+
+/* Daemon configuration file
+{
+	"DenyVfs": ["00:11:22:33:44:55"],
+	"Pfs": {
+		"ens2f0": {
+			"NumVfs": 8,
+			"Eswitch": "switchdev",
+			"InlineMode": "transport",
+			"EncapMode": "basic",
+			"DenyVfs": ["vf0", "0000:05:00.7"]
+		}
+	}
+}
+*/
+
+/* Per PF section of the daemon configuration */
+type Daemon_Pf_Config struct {
+	NumVfs     int    `json:"NumVfs"`
+	Eswitch    string `json:"Eswitch"`
+	InlineMode string `json:"InlineMode"`
+	EncapMode  string `json:"EncapMode"`
+
+	DenyVfs []string `json:"DenyVfs"` // VFs never given to containers
+}
+
+type Daemon_Config struct {
+	Pfs     map[string]*Daemon_Pf_Config `json:"Pfs"`
+	DenyVfs []string                     `json:"DenyVfs"` // VFs of all PFs
+}
+
+// LoadDaemonConfig reads the daemon configuration file. A missing file
+// results in an empty configuration.
+func LoadDaemonConfig(configFile string) (*Daemon_Config, error) {
+	config := Daemon_Config{}
+
+	rawData, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Printf("No daemon config file %s, using defaults\n", configFile)
+			config.Pfs = make(map[string]*Daemon_Pf_Config)
+			return &config, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(rawData, &config)
+	if err != nil {
+		return nil, err
+	}
+	if config.Pfs == nil {
+		config.Pfs = make(map[string]*Daemon_Pf_Config)
+	}
+	_, err = parseVfDenyList(config.DenyVfs)
+	if err != nil {
+		return nil, err
+	}
+	for pfNetdevName := range config.Pfs {
+		_, err = config.vfDenyList(pfNetdevName)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", pfNetdevName, err)
+		}
+	}
+	log.Printf("Loaded daemon config %s: %+v\n", configFile, config)
+	return &config, nil
+}
+
+func (config *Daemon_Config) pfConfig(pfNetdevName string) *Daemon_Pf_Config {
+	if config == nil {
+		return nil
+	}
+	return config.Pfs[pfNetdevName]
+}
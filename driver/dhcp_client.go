@@ -0,0 +1,397 @@
+package driver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+
+	dhcpOpRequest = 1
+	dhcpOpReply   = 2
+
+	dhcpHTypeEthernet = 1
+	dhcpFlagBroadcast = 0x8000
+
+	dhcpHeaderLen = 236
+
+	// Leases without a lease time or with the infinite one are never
+	// renewed, others are renewed no more often than dhcpMinRenewalTime.
+	dhcpInfiniteLease  = 0xffffffff * time.Second
+	dhcpMinRenewalTime = 10 * time.Second
+)
+
+var dhcpMagicCookie = []byte{99, 130, 83, 99}
+
+/* DHCP message types */
+const (
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpDecline  = 4
+	dhcpAck      = 5
+	dhcpNak      = 6
+	dhcpRelease  = 7
+)
+
+/* DHCP options */
+const (
+	dhcpOptPad           = 0
+	dhcpOptSubnetMask    = 1
+	dhcpOptRouter        = 3
+	dhcpOptDNS           = 6
+	dhcpOptRequestedIP   = 50
+	dhcpOptLeaseTime     = 51
+	dhcpOptMessageType   = 53
+	dhcpOptServerID      = 54
+	dhcpOptParamRequest  = 55
+	dhcpOptRenewalTime   = 58
+	dhcpOptRebindingTime = 59
+	dhcpOptClientID      = 61
+	dhcpOptEnd           = 255
+)
+
+type dhcpPacket struct {
+	op      byte
+	xid     uint32
+	flags   uint16
+	ciaddr  net.IP
+	yiaddr  net.IP
+	siaddr  net.IP
+	chaddr  net.HardwareAddr
+	options map[byte][]byte
+}
+
+// dhcpLease is the address configuration handed out by a DHCP server.
+type dhcpLease struct {
+	Address   net.IP
+	Mask      net.IPMask
+	Router    net.IP
+	ServerID  net.IP
+	DNS       []net.IP
+	LeaseTime time.Duration
+	T1        time.Duration
+}
+
+// dhcpTransport sends and receives DHCP messages. Real clients use a UDP
+// socket bound to a netdevice, tests can plug in an in-process server.
+type dhcpTransport interface {
+	Send(pkt []byte, dst net.IP) error
+	Receive(timeout time.Duration) ([]byte, error)
+	Close() error
+}
+
+type dhcpClient struct {
+	conn     dhcpTransport
+	hwAddr   net.HardwareAddr
+	clientID []byte
+	timeout  time.Duration
+	retries  int
+}
+
+func (pkt *dhcpPacket) msgType() byte {
+	value := pkt.options[dhcpOptMessageType]
+	if len(value) != 1 {
+		return 0
+	}
+	return value[0]
+}
+
+func (pkt *dhcpPacket) ipOption(code byte) net.IP {
+	value := pkt.options[code]
+	if len(value) < net.IPv4len {
+		return nil
+	}
+	return net.IP(value[:net.IPv4len])
+}
+
+func (pkt *dhcpPacket) durationOption(code byte) time.Duration {
+	value := pkt.options[code]
+	if len(value) != 4 {
+		return 0
+	}
+	return time.Duration(binary.BigEndian.Uint32(value)) * time.Second
+}
+
+func (pkt *dhcpPacket) marshal() []byte {
+	buf := make([]byte, dhcpHeaderLen)
+
+	buf[0] = pkt.op
+	buf[1] = dhcpHTypeEthernet
+	buf[2] = byte(len(pkt.chaddr))
+	binary.BigEndian.PutUint32(buf[4:8], pkt.xid)
+	binary.BigEndian.PutUint16(buf[10:12], pkt.flags)
+	if pkt.ciaddr != nil {
+		copy(buf[12:16], pkt.ciaddr.To4())
+	}
+	if pkt.yiaddr != nil {
+		copy(buf[16:20], pkt.yiaddr.To4())
+	}
+	if pkt.siaddr != nil {
+		copy(buf[20:24], pkt.siaddr.To4())
+	}
+	copy(buf[28:44], pkt.chaddr)
+
+	buf = append(buf, dhcpMagicCookie...)
+	/* message type always goes first */
+	buf = append(buf, dhcpOptMessageType, 1, pkt.msgType())
+	for code, value := range pkt.options {
+		if code == dhcpOptMessageType {
+			continue
+		}
+		buf = append(buf, code, byte(len(value)))
+		buf = append(buf, value...)
+	}
+	return append(buf, dhcpOptEnd)
+}
+
+func parseDhcpPacket(buf []byte) (*dhcpPacket, error) {
+	if len(buf) < dhcpHeaderLen+len(dhcpMagicCookie) {
+		return nil, fmt.Errorf("dhcp packet too short")
+	}
+	if !bytes.Equal(buf[dhcpHeaderLen:dhcpHeaderLen+4], dhcpMagicCookie) {
+		return nil, fmt.Errorf("invalid dhcp magic cookie")
+	}
+
+	hlen := int(buf[2])
+	if hlen > 16 {
+		return nil, fmt.Errorf("invalid dhcp hardware address length")
+	}
+	pkt := &dhcpPacket{
+		op:      buf[0],
+		xid:     binary.BigEndian.Uint32(buf[4:8]),
+		flags:   binary.BigEndian.Uint16(buf[10:12]),
+		ciaddr:  net.IP(append([]byte{}, buf[12:16]...)),
+		yiaddr:  net.IP(append([]byte{}, buf[16:20]...)),
+		siaddr:  net.IP(append([]byte{}, buf[20:24]...)),
+		chaddr:  net.HardwareAddr(append([]byte{}, buf[28:28+hlen]...)),
+		options: make(map[byte][]byte),
+	}
+
+	opts := buf[dhcpHeaderLen+4:]
+	for len(opts) > 0 {
+		code := opts[0]
+		if code == dhcpOptEnd {
+			break
+		}
+		if code == dhcpOptPad {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return nil, fmt.Errorf("truncated dhcp option %d", code)
+		}
+		pkt.options[code] = append([]byte{}, opts[2:2+int(opts[1])]...)
+		opts = opts[2+int(opts[1]):]
+	}
+	return pkt, nil
+}
+
+// dhcpClientID derives the DHCP client identifier from a MAC address.
+func dhcpClientID(hwAddr net.HardwareAddr) []byte {
+	return append([]byte{dhcpHTypeEthernet}, hwAddr...)
+}
+
+func newDhcpClient(conn dhcpTransport, hwAddr net.HardwareAddr) *dhcpClient {
+	return &dhcpClient{
+		conn:     conn,
+		hwAddr:   hwAddr,
+		clientID: dhcpClientID(hwAddr),
+		timeout:  2 * time.Second,
+		retries:  3,
+	}
+}
+
+func (c *dhcpClient) newPacket(msgType byte, xid uint32) *dhcpPacket {
+	pkt := &dhcpPacket{
+		op:      dhcpOpRequest,
+		xid:     xid,
+		flags:   dhcpFlagBroadcast,
+		chaddr:  c.hwAddr,
+		options: make(map[byte][]byte),
+	}
+	pkt.options[dhcpOptMessageType] = []byte{msgType}
+	pkt.options[dhcpOptClientID] = c.clientID
+	pkt.options[dhcpOptParamRequest] = []byte{dhcpOptSubnetMask,
+		dhcpOptRouter, dhcpOptDNS, dhcpOptLeaseTime,
+		dhcpOptRenewalTime, dhcpOptRebindingTime}
+	return pkt
+}
+
+// exchange sends the packet and waits for a reply of one of the expected
+// message types, retransmitting on timeout.
+func (c *dhcpClient) exchange(pkt *dhcpPacket, dst net.IP, expected ...byte) (*dhcpPacket, error) {
+	buf := pkt.marshal()
+
+	for attempt := 0; attempt < c.retries; attempt++ {
+		err := c.conn.Send(buf, dst)
+		if err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(c.timeout)
+		for time.Now().Before(deadline) {
+			rawReply, err2 := c.conn.Receive(deadline.Sub(time.Now()))
+			if err2 != nil {
+				break
+			}
+			reply, err2 := parseDhcpPacket(rawReply)
+			if err2 != nil || reply.op != dhcpOpReply || reply.xid != pkt.xid {
+				continue
+			}
+			for _, msgType := range expected {
+				if reply.msgType() == msgType {
+					return reply, nil
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("no dhcp reply for %v", c.hwAddr)
+}
+
+func leaseFromAck(ack *dhcpPacket) *dhcpLease {
+	lease := &dhcpLease{
+		Address:   ack.yiaddr,
+		Router:    ack.ipOption(dhcpOptRouter),
+		ServerID:  ack.ipOption(dhcpOptServerID),
+		LeaseTime: ack.durationOption(dhcpOptLeaseTime),
+		T1:        ack.durationOption(dhcpOptRenewalTime),
+	}
+	if mask := ack.options[dhcpOptSubnetMask]; len(mask) == net.IPv4len {
+		lease.Mask = net.IPMask(mask)
+	}
+	dns := ack.options[dhcpOptDNS]
+	for len(dns) >= net.IPv4len {
+		lease.DNS = append(lease.DNS, net.IP(dns[:net.IPv4len]))
+		dns = dns[net.IPv4len:]
+	}
+	if lease.LeaseTime == 0 || lease.LeaseTime == dhcpInfiniteLease {
+		/* never renewed */
+		lease.LeaseTime = 0
+		lease.T1 = 0
+		return lease
+	}
+	if lease.T1 == 0 || lease.T1 >= lease.LeaseTime {
+		lease.T1 = lease.LeaseTime / 2
+	}
+	if lease.T1 < dhcpMinRenewalTime {
+		lease.T1 = dhcpMinRenewalTime
+	}
+	return lease
+}
+
+// Acquire obtains a new lease through DISCOVER/OFFER/REQUEST/ACK.
+func (c *dhcpClient) Acquire() (*dhcpLease, error) {
+	xid := rand.Uint32()
+
+	offer, err := c.exchange(c.newPacket(dhcpDiscover, xid), net.IPv4bcast, dhcpOffer)
+	if err != nil {
+		return nil, err
+	}
+
+	request := c.newPacket(dhcpRequest, xid)
+	request.options[dhcpOptRequestedIP] = offer.yiaddr.To4()
+	if serverID := offer.ipOption(dhcpOptServerID); serverID != nil {
+		request.options[dhcpOptServerID] = serverID.To4()
+	}
+
+	ack, err := c.exchange(request, net.IPv4bcast, dhcpAck, dhcpNak)
+	if err != nil {
+		return nil, err
+	}
+	if ack.msgType() == dhcpNak {
+		return nil, fmt.Errorf("dhcp server declined address %v", offer.yiaddr)
+	}
+	return leaseFromAck(ack), nil
+}
+
+// Renew extends a lease by unicasting a REQUEST to the leasing server.
+func (c *dhcpClient) Renew(lease *dhcpLease) (*dhcpLease, error) {
+	request := c.newPacket(dhcpRequest, rand.Uint32())
+	request.flags = 0
+	request.ciaddr = lease.Address
+
+	ack, err := c.exchange(request, lease.ServerID, dhcpAck, dhcpNak)
+	if err != nil {
+		return nil, err
+	}
+	if ack.msgType() == dhcpNak {
+		return nil, fmt.Errorf("dhcp server refused to renew %v", lease.Address)
+	}
+	return leaseFromAck(ack), nil
+}
+
+// Release gives the leased address back to the server.
+func (c *dhcpClient) Release(lease *dhcpLease) error {
+	release := c.newPacket(dhcpRelease, rand.Uint32())
+	release.flags = 0
+	release.ciaddr = lease.Address
+	release.options[dhcpOptServerID] = lease.ServerID.To4()
+	delete(release.options, dhcpOptParamRequest)
+
+	return c.conn.Send(release.marshal(), lease.ServerID)
+}
+
+type dhcpDeviceConn struct {
+	conn net.PacketConn
+}
+
+// newDhcpDeviceConn opens a DHCP client socket bound to the given netdevice
+// in the current network namespace.
+func newDhcpDeviceConn(netdevName string) (*dhcpDeviceConn, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	if err == nil {
+		err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+	}
+	if err == nil {
+		err = syscall.SetsockoptString(fd, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, netdevName)
+	}
+	if err == nil {
+		err = syscall.Bind(fd, &syscall.SockaddrInet4{Port: dhcpClientPort})
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("Fail to open dhcp socket on %s: %v", netdevName, err)
+	}
+
+	file := os.NewFile(uintptr(fd), "dhcp-"+netdevName)
+	defer file.Close()
+
+	conn, err := net.FilePacketConn(file)
+	if err != nil {
+		return nil, err
+	}
+	return &dhcpDeviceConn{conn: conn}, nil
+}
+
+func (c *dhcpDeviceConn) Send(pkt []byte, dst net.IP) error {
+	_, err := c.conn.WriteTo(pkt, &net.UDPAddr{IP: dst, Port: dhcpServerPort})
+	return err
+}
+
+func (c *dhcpDeviceConn) Receive(timeout time.Duration) ([]byte, error) {
+	buf := make([]byte, 1500)
+
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	n, _, err := c.conn.ReadFrom(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func (c *dhcpDeviceConn) Close() error {
+	return c.conn.Close()
+}
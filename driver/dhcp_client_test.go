@@ -0,0 +1,250 @@
+package driver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeDhcpServer is an in-process DHCP server plugged in as the transport
+// of a client. It answers each message synchronously.
+type fakeDhcpServer struct {
+	serverID  net.IP
+	address   net.IP
+	router    net.IP
+	leaseTime uint32
+	nak       bool // refuse requests
+	silent    bool // drop all messages
+
+	leased   map[string]net.IP // by client MAC address
+	released []net.IP
+	sent     int
+	replies  chan []byte
+}
+
+func newFakeDhcpServer() *fakeDhcpServer {
+	return &fakeDhcpServer{
+		serverID:  net.ParseIP("10.0.0.1").To4(),
+		address:   net.ParseIP("10.0.0.50").To4(),
+		router:    net.ParseIP("10.0.0.254").To4(),
+		leaseTime: 600,
+		leased:    make(map[string]net.IP),
+		replies:   make(chan []byte, 4),
+	}
+}
+
+func (s *fakeDhcpServer) reply(req *dhcpPacket, msgType byte, yiaddr net.IP) {
+	lease := make([]byte, 4)
+	binary.BigEndian.PutUint32(lease, s.leaseTime)
+
+	pkt := &dhcpPacket{
+		op:      dhcpOpReply,
+		xid:     req.xid,
+		yiaddr:  yiaddr,
+		chaddr:  req.chaddr,
+		options: make(map[byte][]byte),
+	}
+	pkt.options[dhcpOptMessageType] = []byte{msgType}
+	pkt.options[dhcpOptServerID] = s.serverID
+	if msgType != dhcpNak {
+		pkt.options[dhcpOptSubnetMask] = net.CIDRMask(24, 32)
+		pkt.options[dhcpOptRouter] = s.router
+		pkt.options[dhcpOptLeaseTime] = lease
+	}
+	s.replies <- pkt.marshal()
+}
+
+func (s *fakeDhcpServer) Send(buf []byte, dst net.IP) error {
+	s.sent++
+	if s.silent {
+		return nil
+	}
+	req, err := parseDhcpPacket(buf)
+	if err != nil {
+		return err
+	}
+	if req.op != dhcpOpRequest {
+		return fmt.Errorf("unexpected op %d", req.op)
+	}
+
+	mac := req.chaddr.String()
+	switch req.msgType() {
+	case dhcpDiscover:
+		s.reply(req, dhcpOffer, s.address)
+	case dhcpRequest:
+		if s.nak {
+			s.reply(req, dhcpNak, nil)
+			return nil
+		}
+		if !req.ciaddr.IsUnspecified() {
+			/* renewal is unicast to the server with the leased address */
+			if !dst.Equal(s.serverID) || !req.ciaddr.Equal(s.leased[mac]) {
+				s.reply(req, dhcpNak, nil)
+				return nil
+			}
+			s.reply(req, dhcpAck, req.ciaddr)
+			return nil
+		}
+		if !req.ipOption(dhcpOptRequestedIP).Equal(s.address) ||
+			!req.ipOption(dhcpOptServerID).Equal(s.serverID) {
+			s.reply(req, dhcpNak, nil)
+			return nil
+		}
+		s.leased[mac] = s.address
+		s.reply(req, dhcpAck, s.address)
+	case dhcpRelease:
+		if req.ciaddr.Equal(s.leased[mac]) {
+			delete(s.leased, mac)
+			s.released = append(s.released, req.ciaddr)
+		}
+	}
+	return nil
+}
+
+func (s *fakeDhcpServer) Receive(timeout time.Duration) ([]byte, error) {
+	select {
+	case buf := <-s.replies:
+		return buf, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("timeout")
+	}
+}
+
+func (s *fakeDhcpServer) Close() error {
+	return nil
+}
+
+func newTestDhcpClient(server *fakeDhcpServer) *dhcpClient {
+	hwAddr, _ := net.ParseMAC("ce:d0:9a:3f:16:0b")
+	client := newDhcpClient(server, hwAddr)
+	client.timeout = 10 * time.Millisecond
+	return client
+}
+
+func TestDhcpAcquire(t *testing.T) {
+	server := newFakeDhcpServer()
+	client := newTestDhcpClient(server)
+
+	lease, err := client.Acquire()
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if !lease.Address.Equal(server.address) {
+		t.Errorf("address %v, expected %v", lease.Address, server.address)
+	}
+	if !lease.Router.Equal(server.router) || !lease.ServerID.Equal(server.serverID) {
+		t.Errorf("router %v server %v", lease.Router, lease.ServerID)
+	}
+	if lease.LeaseTime != 600*time.Second || lease.T1 != 300*time.Second {
+		t.Errorf("lease time %v T1 %v", lease.LeaseTime, lease.T1)
+	}
+	if ones, _ := lease.Mask.Size(); ones != 24 {
+		t.Errorf("mask %v", lease.Mask)
+	}
+	if !server.leased[client.hwAddr.String()].Equal(server.address) {
+		t.Errorf("server has no lease for %v", client.hwAddr)
+	}
+}
+
+func TestDhcpAcquireNak(t *testing.T) {
+	server := newFakeDhcpServer()
+	server.nak = true
+	client := newTestDhcpClient(server)
+
+	_, err := client.Acquire()
+	if err == nil {
+		t.Fatalf("Acquire succeeded on NAK")
+	}
+}
+
+func TestDhcpAcquireTimeout(t *testing.T) {
+	server := newFakeDhcpServer()
+	server.silent = true
+	client := newTestDhcpClient(server)
+
+	_, err := client.Acquire()
+	if err == nil {
+		t.Fatalf("Acquire succeeded without server")
+	}
+	if server.sent != client.retries {
+		t.Errorf("sent %d discovers, expected %d", server.sent, client.retries)
+	}
+}
+
+func TestDhcpRenew(t *testing.T) {
+	server := newFakeDhcpServer()
+	client := newTestDhcpClient(server)
+
+	lease, err := client.Acquire()
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	server.leaseTime = 1200
+	renewed, err := client.Renew(lease)
+	if err != nil {
+		t.Fatalf("Renew: %v", err)
+	}
+	if !renewed.Address.Equal(lease.Address) || renewed.LeaseTime != 1200*time.Second {
+		t.Errorf("renewed lease %v for %v", renewed.Address, renewed.LeaseTime)
+	}
+
+	delete(server.leased, client.hwAddr.String())
+	_, err = client.Renew(lease)
+	if err == nil {
+		t.Errorf("Renew succeeded for an unknown lease")
+	}
+}
+
+func TestDhcpRelease(t *testing.T) {
+	server := newFakeDhcpServer()
+	client := newTestDhcpClient(server)
+
+	lease, err := client.Acquire()
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	err = client.Release(lease)
+	if err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if len(server.released) != 1 || !server.released[0].Equal(lease.Address) {
+		t.Errorf("released %v, expected %v", server.released, lease.Address)
+	}
+	if server.leased[client.hwAddr.String()] != nil {
+		t.Errorf("server still has a lease for %v", client.hwAddr)
+	}
+}
+
+func TestDhcpLeaseRenewalTime(t *testing.T) {
+	tests := []struct {
+		leaseTime []byte
+		t1        []byte
+		expLease  time.Duration
+		expT1     time.Duration
+	}{
+		{[]byte{0, 0, 2, 88}, nil, 600 * time.Second, 300 * time.Second},
+		{[]byte{0, 0, 2, 88}, []byte{0, 0, 0, 100}, 600 * time.Second, 100 * time.Second},
+		{[]byte{0, 0, 2, 88}, []byte{0, 0, 3, 0}, 600 * time.Second, 300 * time.Second},
+		{[]byte{0, 0, 0, 4}, nil, 4 * time.Second, dhcpMinRenewalTime},
+		{[]byte{0, 0, 2, 88}, []byte{0, 0, 0, 0}, 600 * time.Second, 300 * time.Second},
+		{nil, nil, 0, 0},
+		{nil, []byte{0, 0, 0, 100}, 0, 0},
+		{[]byte{0xff, 0xff, 0xff, 0xff}, nil, 0, 0},
+	}
+	for _, test := range tests {
+		ack := &dhcpPacket{options: make(map[byte][]byte)}
+		if test.leaseTime != nil {
+			ack.options[dhcpOptLeaseTime] = test.leaseTime
+		}
+		if test.t1 != nil {
+			ack.options[dhcpOptRenewalTime] = test.t1
+		}
+		lease := leaseFromAck(ack)
+		if lease.LeaseTime != test.expLease || lease.T1 != test.expT1 {
+			t.Errorf("lease time %v T1 %v: got lease time %v T1 %v, expected %v %v",
+				test.leaseTime, test.t1, lease.LeaseTime, lease.T1, test.expLease, test.expT1)
+		}
+	}
+}
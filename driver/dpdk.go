@@ -0,0 +1,174 @@
+package driver
+
+import (
+	"fmt"
+	"github.com/docker/go-plugins-helpers/network"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	pciSysDir           = "/sys/bus/pci"
+	pciDevicesDir       = "/sys/bus/pci/devices"
+	pciDriversProbeFile = "/sys/bus/pci/drivers_probe"
+	pciDriverOverride   = "driver_override"
+	vfioPciDriver       = "vfio-pci"
+	vfioDevDir          = "/dev/vfio"
+)
+
+// dpdkNetwork hands containers VFs bound to vfio-pci for use by DPDK
+// applications, instead of kernel netdevices.
+type dpdkNetwork struct {
+	sriovNetwork
+}
+
+func pciDevDriver(pciAddr string) string {
+	driverLink, err := os.Readlink(filepath.Join(pciDevicesDir, pciAddr, "driver"))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(driverLink)
+}
+
+func pciDevVfioGroup(pciAddr string) (string, error) {
+	groupLink, err := os.Readlink(filepath.Join(pciDevicesDir, pciAddr, "iommu_group"))
+	if err != nil {
+		return "", fmt.Errorf("no iommu group for %s: %v", pciAddr, err)
+	}
+	return filepath.Join(vfioDevDir, filepath.Base(groupLink)), nil
+}
+
+func setPciDriverOverride(pciAddr string, driver string) error {
+	overrideFile := fileObject{
+		Path: filepath.Join(pciDevicesDir, pciAddr, pciDriverOverride),
+	}
+	if driver == "" {
+		/* a newline clears the override */
+		driver = "\n"
+	}
+	return overrideFile.Write(driver)
+}
+
+// bindVfToVfio rebinds a VF from the PF driver to vfio-pci using
+// driver_override and returns the driver it was bound to.
+func bindVfToVfio(pfNetdevName string, vfPciAddr string) (string, error) {
+	var err error
+
+	origDriver := pciDevDriver(vfPciAddr)
+	if origDriver == vfioPciDriver {
+		return origDriver, nil
+	}
+
+	if !dirExists(filepath.Join(pciSysDir, "drivers", vfioPciDriver)) {
+		err = runCommand("modprobe", vfioPciDriver)
+		if err != nil {
+			return "", fmt.Errorf("Fail to load %s, is /lib/modules mounted in the plugin container? %v",
+				vfioPciDriver, err)
+		}
+	}
+
+	if origDriver != "" {
+		err = unbindVF(pfNetdevName, vfPciAddr)
+		if err != nil {
+			return "", fmt.Errorf("Fail to unbind %s: %v", vfPciAddr, err)
+		}
+	}
+
+	err = setPciDriverOverride(vfPciAddr, vfioPciDriver)
+	if err == nil {
+		probeFile := fileObject{Path: pciDriversProbeFile}
+		err = probeFile.Write(vfPciAddr)
+	}
+	if err == nil && pciDevDriver(vfPciAddr) != vfioPciDriver {
+		err = fmt.Errorf("%s is not bound to %s", vfPciAddr, vfioPciDriver)
+	}
+	if err != nil {
+		restoreVfDriver(pfNetdevName, vfPciAddr, origDriver)
+		return "", err
+	}
+	return origDriver, nil
+}
+
+// restoreVfDriver unbinds a VF from vfio-pci and binds it back to the
+// driver it had before.
+func restoreVfDriver(pfNetdevName string, vfPciAddr string, origDriver string) error {
+
+	if pciDevDriver(vfPciAddr) == vfioPciDriver {
+		unbindFile := fileObject{
+			Path: filepath.Join(pciSysDir, "drivers", vfioPciDriver, netdevUnbindFile),
+		}
+		err := unbindFile.Write(vfPciAddr)
+		if err != nil {
+			return err
+		}
+	}
+	err := setPciDriverOverride(vfPciAddr, "")
+	if err != nil {
+		return err
+	}
+	if origDriver == "" || origDriver == vfioPciDriver {
+		return nil
+	}
+	return bindVF(pfNetdevName, vfPciAddr)
+}
+
+func (nw *dpdkNetwork) CreateEndpoint(r *network.CreateEndpointRequest) (*network.CreateEndpointResponse, error) {
+
+	resp, err := nw.sriovNetwork.CreateEndpoint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := nw.genNw.ndevEndpoints[r.EndpointID]
+	vfPciAddr := endpoint.vfObj.PciAddress
+
+	hwAddr := r.Interface.MacAddress
+	if hwAddr == "" {
+		hwAddr, _ = GetVFDefaultMacAddr(endpoint.devName)
+	}
+
+	vfioGroup, err := pciDevVfioGroup(vfPciAddr)
+	if err == nil {
+		endpoint.vfDriver, err = bindVfToVfio(nw.genNw.ndevName, vfPciAddr)
+	}
+	if err != nil {
+		nw.sriovNetwork.DeleteEndpoint(endpoint)
+		delete(nw.genNw.ndevEndpoints, r.EndpointID)
+		return nil, fmt.Errorf("Fail to bind vf %s to %s err = %v", vfPciAddr, vfioPciDriver, err)
+	}
+
+	// VF has no kernel netdevice anymore, so nothing is moved to the
+	// container on Join.
+	endpoint.devName = ""
+	endpoint.HardwareAddr = hwAddr
+	endpoint.vfioGroup = vfioGroup
+
+	log.Printf("DPDK CreateEndpoint vf: %s vfio group: %s\n", vfPciAddr, vfioGroup)
+	return resp, nil
+}
+
+func (nw *dpdkNetwork) DeleteEndpoint(endpoint *ptEndpoint) {
+
+	vfPciAddr := endpoint.vfObj.PciAddress
+	err := restoreVfDriver(nw.genNw.ndevName, vfPciAddr, endpoint.vfDriver)
+	if err != nil {
+		log.Printf("Fail to restore driver of vf %s: %v\n", vfPciAddr, err)
+	}
+	nw.sriovNetwork.DeleteEndpoint(endpoint)
+}
+
+// RestoreEndpoint takes over a VF bound to vfio-pci before the plugin
+// restarted.
+func (nw *dpdkNetwork) RestoreEndpoint(id string, dbEp *DB_Endpoint) error {
+
+	err := nw.sriovNetwork.RestoreEndpoint(id, dbEp)
+	if err != nil {
+		return err
+	}
+	endpoint := nw.genNw.ndevEndpoints[id]
+	endpoint.HardwareAddr = dbEp.HwAddress
+	endpoint.vfioGroup = dbEp.VfioGroup
+	endpoint.vfDriver = dbEp.VfDriver
+	return nil
+}
@@ -2,30 +2,70 @@ package driver
 
 import (
 	"fmt"
+	"github.com/Mellanox/rdmamap"
 	"github.com/Mellanox/sriovnet"
 	"github.com/docker/go-plugins-helpers/network"
 	"github.com/docker/libnetwork/netlabel"
 	"github.com/docker/libnetwork/options"
+	"github.com/vishvananda/netlink"
 	"log"
 	"net"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 const (
 	containerVethPrefix = "eth"
-	networkDevice       = "netdevice" // netdevice interface -o netdevice
+	networkDevice       = "netdevice"   // netdevice interface -o netdevice
+	networkPfSelector   = "pf_selector" // PF selector instead of netdevice
 
 	networkMode       = "mode"
 	networkModePT     = "passthrough"
 	networkModeSRIOV  = "sriov"
+	networkModeSF     = "sf"
+	networkModeVDPA   = "vdpa"
+	networkModeDPDK   = "sriov-dpdk"
+	networkModeIPoIB  = "ipoib-child"
+	networkModeVLAN   = "vlan"
 	sriovVlan         = "vlan"
 	networkPrivileged = "privileged"
 	ethPrefix         = "prefix"
 	roceHopLimit      = "rocehoplimit"
+	roceTos           = "roce_tos"
+	roceGidType       = "roce_gid_type"
+
+	networkEswitch       = "eswitch"
+	eswitchModeLegacy    = "legacy"
+	eswitchModeSwitchdev = "switchdev"
+	networkBridge        = "bridge"      // bridge of VF representors in switchdev mode
+	networkBridgeType    = "bridge_type" // linux or ovs
+	bridgeTypeLinux      = "linux"
+	bridgeTypeOVS        = "ovs"
+	networkAcl           = "acl" // tc flower rules of VF representors
+	networkNumVfs        = "numvfs"
+	networkInlineMode    = "inline_mode"
+	networkEncapMode     = "encap_mode"
+	networkSfRate        = "sf_rate"
+	networkRdmaNetns     = "rdma_netns" // exclusive to move RDMA devices to containers
+	networkWaitReady     = "wait_ready" // time to wait for VF readiness on Join
+	networkGuidPool      = "guid_pool"  // GUID range of InfiniBand VFs
+	networkPkey          = "pkey"       // InfiniBand partition key
+	networkIPoIBMode     = "ipoib_mode" // datagram or connected
+	networkBond          = "bond"       // bond mode of VFs of two PFs
+	networkSlaves        = "slaves"     // netdevices bonded in passthrough mode
+	networkBondMode      = "bond_mode"  // bond mode of slaves in passthrough mode
+	networkPfPool        = "pf_pool"    // selector of PFs of the network
+	networkPfPolicy      = "pf_policy"  // most-free or least-load PF for endpoints
+	networkNuma          = "numa"       // strict, preferred or ignore NUMA locality
+	networkVfPolicy      = "vf_policy"  // choice of the VF of new endpoints
+	networkVfs           = "vfs"        // VF indices of the network
+	networkReserve       = "reserve"    // VFs kept free for the network
+	networkMaxEndpoints  = "max_endpoints"
 )
 
 type ptEndpoint struct {
@@ -40,6 +80,19 @@ type ptEndpoint struct {
 	sandboxKey   string
 	vfName       string
 	vfObj        *sriovnet.VfObj
+	vfRepName    string
+	sfNum        int
+	sfPort       string
+	vdpaName     string
+	vfioGroup    string
+	vfDriver     string // VF driver before binding to vfio-pci
+	rdmaDev      string // RDMA device moved to the sandbox
+	rdmaState    *rdmaTuningState
+	guid         uint64 // InfiniBand VF node and port GUID
+	pkeyState    *rdmaTuningState
+	slaveStates  []*linkState  // passthrough slaves before bonding
+	slaves       []*ptEndpoint // endpoints bonded for the container
+	pf           string        // PF of the VF in networks with several PFs
 }
 
 type genericNetwork struct {
@@ -50,12 +103,26 @@ type genericNetwork struct {
 	driver        *driver // The network's driver
 	mode          string  // SRIOV or Passthough
 	ethPrefix     string
+	rdmaNetns     string
+	rdmaTuning    *rdmaTuning
+	waitReady     time.Duration
+	numaPolicy    string
+	numaNodes     []int // of the container of the endpoint being created
+	maxEndpoints  int   // 0 for no limit
 
 	ndevName string
 }
 
 type ptNetwork struct {
-	genNw *genericNetwork
+	genNw    *genericNetwork
+	slaves   []string // bonded and passed through instead of netdevice
+	bondMode netlink.BondMode
+}
+
+// endpointRestorer is implemented by networks which take over their
+// endpoints again when the plugin restarts.
+type endpointRestorer interface {
+	RestoreEndpoint(id string, dbEp *DB_Endpoint) error
 }
 
 type NwIface interface {
@@ -73,6 +140,8 @@ type NwIface interface {
 type driver struct {
 	// below map maps a network id to NwInterface object
 	networks map[string]NwIface
+	ipam     *ipamDriver
+	config   *Daemon_Config
 	sync.Mutex
 }
 
@@ -129,16 +198,18 @@ func parseNetworkGenericOptions(data interface{}) (map[string]string, error) {
 		options[networkMode] = networkModeSRIOV
 	} else {
 		if options[networkMode] != networkModePT &&
-			options[networkMode] != networkModeSRIOV {
-			return options, fmt.Errorf("valid modes are: passthrough and sriov")
+			options[networkMode] != networkModeSRIOV &&
+			options[networkMode] != networkModeSF &&
+			options[networkMode] != networkModeVDPA &&
+			options[networkMode] != networkModeDPDK &&
+			options[networkMode] != networkModeIPoIB &&
+			options[networkMode] != networkModeVLAN {
+			return options, fmt.Errorf("valid modes are: passthrough, sriov, sriov-dpdk, sf, vdpa, ipoib-child and vlan")
 		}
 	}
-	if options[networkDevice] == "" {
-		if options[networkMode] == networkModeSRIOV {
-			return options, fmt.Errorf("sriov mode requires netdevice")
-		} else {
-			return options, fmt.Errorf("passthrough mode requires netdevice")
-		}
+	if options[networkDevice] == "" && options[networkPfPool] == "" && options[networkPfSelector] == "" &&
+		(options[networkMode] != networkModePT || options[networkSlaves] == "") {
+		return options, fmt.Errorf("%s mode requires netdevice", options[networkMode])
 	}
 
 	if options[ethPrefix] == "" {
@@ -164,7 +235,78 @@ func (d *driver) _CreateNetwork(nid string, options map[string]string,
 	ipv4Data *network.IPAMData, storeConfig bool) error {
 	var err error
 
+	// PF is resolved once, the network is stored with the resolved PF.
+	if options[networkDevice] == pfSelectorAuto || options[networkPfSelector] != "" {
+		if options[networkDevice] != pfSelectorAuto && options[networkDevice] != "" {
+			return fmt.Errorf("pf_selector and netdevice are exclusive")
+		}
+		selector := options[networkPfSelector]
+		if selector == "" {
+			selector = pfSelectorAuto
+		}
+		sriov := options[networkMode] == networkModeSRIOV ||
+			options[networkMode] == networkModeDPDK ||
+			options[networkMode] == networkModeVDPA
+		options[networkDevice], err = resolvePfSelector(selector, sriov)
+		if err != nil {
+			return err
+		}
+		log.Printf("PF selector %s resolved to %s\n", selector, options[networkDevice])
+	}
+
+	err = checkRdmaNetnsMode(options[networkRdmaNetns])
+	if err != nil {
+		return err
+	}
+	tuning, err := parseRdmaTuning(options)
+	if err != nil {
+		return err
+	}
+	if options[networkMode] == networkModeDPDK && !tuning.isEmpty() {
+		return fmt.Errorf("rdma settings are unsupported in sriov-dpdk mode")
+	}
+	if options[networkMode] == networkModeVLAN &&
+		(!tuning.isEmpty() || options[networkRdmaNetns] != "") {
+		return fmt.Errorf("rdma settings are unsupported in vlan mode")
+	}
+	if options[networkBond] != "" && options[networkMode] != networkModeSRIOV {
+		return fmt.Errorf("bond is supported only in sriov mode")
+	}
+	if (options[networkPfPool] != "" || strings.Contains(options[networkDevice], ",")) &&
+		options[networkMode] != networkModeSRIOV {
+		return fmt.Errorf("networks with several PFs are supported only in sriov mode")
+	}
+	if (options[networkVfPolicy] != "" || options[networkVfs] != "" || options[networkReserve] != "") &&
+		options[networkMode] != networkModeSRIOV &&
+		options[networkMode] != networkModeDPDK && options[networkMode] != networkModeVDPA {
+		return fmt.Errorf("vf_policy, vfs and reserve are supported only in sriov, sriov-dpdk and vdpa modes")
+	}
+	maxEndpoints, err := parseMaxEndpoints(options[networkMaxEndpoints])
+	if err != nil {
+		return err
+	}
+	if options[networkReserve] != "" && maxEndpoints > 0 {
+		reserve, _ := strconv.Atoi(options[networkReserve])
+		if reserve > maxEndpoints {
+			return fmt.Errorf("reserve %d exceeds max_endpoints %d", reserve, maxEndpoints)
+		}
+	}
+	waitReady, err := parseWaitReady(options[networkWaitReady])
+	if err != nil {
+		return err
+	}
+	numaPolicy, err := parseNumaPolicy(options[networkNuma])
+	if err != nil {
+		return err
+	}
+
 	genNw := createGenNw(nid, options[networkDevice], options[networkMode], options[ethPrefix], ipv4Data)
+	genNw.driver = d
+	genNw.rdmaNetns = options[networkRdmaNetns]
+	genNw.rdmaTuning = tuning
+	genNw.waitReady = waitReady
+	genNw.numaPolicy = numaPolicy
+	genNw.maxEndpoints = maxEndpoints
 
 	if options[networkMode] == "passthrough" {
 		nw := ptNetwork{}
@@ -173,6 +315,61 @@ func (d *driver) _CreateNetwork(nid string, options map[string]string,
 			return err
 		}
 		d.networks[nid] = &nw
+	} else if options[networkMode] == networkModeSF {
+		nw := sfNetwork{}
+		err = nw.CreateNetwork(d, genNw, nid, options, ipv4Data)
+		if err != nil {
+			return err
+		}
+		d.networks[nid] = &nw
+	} else if options[networkMode] == networkModeVDPA {
+		if checkMultiPortDevice(options[networkDevice]) {
+			return fmt.Errorf("vdpa mode is not supported on multiport device %s", options[networkDevice])
+		}
+		nw := vdpaNetwork{}
+		err = nw.CreateNetwork(d, genNw, nid, options, ipv4Data)
+		if err != nil {
+			return err
+		}
+		d.networks[nid] = &nw
+	} else if options[networkMode] == networkModeDPDK {
+		if checkMultiPortDevice(options[networkDevice]) {
+			return fmt.Errorf("sriov-dpdk mode is not supported on multiport device %s", options[networkDevice])
+		}
+		nw := dpdkNetwork{}
+		err = nw.CreateNetwork(d, genNw, nid, options, ipv4Data)
+		if err != nil {
+			return err
+		}
+		d.networks[nid] = &nw
+	} else if options[networkMode] == networkModeVLAN {
+		nw := vlanNetwork{}
+		err = nw.CreateNetwork(d, genNw, nid, options, ipv4Data)
+		if err != nil {
+			return err
+		}
+		d.networks[nid] = &nw
+	} else if options[networkMode] == networkModeIPoIB {
+		nw := ipoibChildNetwork{}
+		err = nw.CreateNetwork(d, genNw, nid, options, ipv4Data)
+		if err != nil {
+			return err
+		}
+		d.networks[nid] = &nw
+	} else if options[networkBond] != "" {
+		nw := bondSriovNetwork{}
+		err = nw.CreateNetwork(d, genNw, nid, options, ipv4Data)
+		if err != nil {
+			return err
+		}
+		d.networks[nid] = &nw
+	} else if options[networkPfPool] != "" || strings.Contains(options[networkDevice], ",") {
+		nw := multiPfNetwork{}
+		err = nw.CreateNetwork(d, genNw, nid, options, ipv4Data)
+		if err != nil {
+			return err
+		}
+		d.networks[nid] = &nw
 	} else {
 		var multiport bool
 
@@ -202,6 +399,33 @@ func (d *driver) _CreateNetwork(nid string, options map[string]string,
 		nwDbEntry.Netdev = options[networkDevice]
 		nwDbEntry.Vlan, _ = strconv.Atoi(options[sriovVlan])
 		nwDbEntry.Gateway = ipv4Data.Gateway
+		nwDbEntry.Subnet = ipv4Data.Pool
+		nwDbEntry.Eswitch = options[networkEswitch]
+		nwDbEntry.Bridge = options[networkBridge]
+		nwDbEntry.BridgeType = options[networkBridgeType]
+		nwDbEntry.Acl = options[networkAcl]
+		nwDbEntry.NumVfs, _ = strconv.Atoi(options[networkNumVfs])
+		nwDbEntry.InlineMode = options[networkInlineMode]
+		nwDbEntry.EncapMode = options[networkEncapMode]
+		nwDbEntry.SfRate = options[networkSfRate]
+		nwDbEntry.RdmaNetns = options[networkRdmaNetns]
+		nwDbEntry.RoceHopLimit = options[roceHopLimit]
+		nwDbEntry.RoceTos = options[roceTos]
+		nwDbEntry.RoceGidType = options[roceGidType]
+		nwDbEntry.WaitReady = options[networkWaitReady]
+		nwDbEntry.GuidPool = options[networkGuidPool]
+		nwDbEntry.Pkey = options[networkPkey]
+		nwDbEntry.IPoIBMode = options[networkIPoIBMode]
+		nwDbEntry.Bond = options[networkBond]
+		nwDbEntry.Slaves = options[networkSlaves]
+		nwDbEntry.BondMode = options[networkBondMode]
+		nwDbEntry.PfPool = options[networkPfPool]
+		nwDbEntry.PfPolicy = options[networkPfPolicy]
+		nwDbEntry.Numa = options[networkNuma]
+		nwDbEntry.VfPolicy = options[networkVfPolicy]
+		nwDbEntry.Vfs = options[networkVfs]
+		nwDbEntry.Reserve = options[networkReserve]
+		nwDbEntry.MaxEndpoints = options[networkMaxEndpoints]
 
 		if options[networkPrivileged] == "1" {
 			nwDbEntry.Privileged = true
@@ -278,6 +502,34 @@ func BuildNetworkOptions(nwDbEntry *Db_Network_Info) (map[string]string, error)
 	options[networkDevice] = nwDbEntry.Netdev
 	options[networkMode] = nwDbEntry.Mode
 	options[sriovVlan] = strconv.Itoa(nwDbEntry.Vlan)
+	options[networkEswitch] = nwDbEntry.Eswitch
+	options[networkBridge] = nwDbEntry.Bridge
+	options[networkBridgeType] = nwDbEntry.BridgeType
+	options[networkAcl] = nwDbEntry.Acl
+	if nwDbEntry.NumVfs != 0 {
+		options[networkNumVfs] = strconv.Itoa(nwDbEntry.NumVfs)
+	}
+	options[networkInlineMode] = nwDbEntry.InlineMode
+	options[networkEncapMode] = nwDbEntry.EncapMode
+	options[networkSfRate] = nwDbEntry.SfRate
+	options[networkRdmaNetns] = nwDbEntry.RdmaNetns
+	options[roceHopLimit] = nwDbEntry.RoceHopLimit
+	options[roceTos] = nwDbEntry.RoceTos
+	options[roceGidType] = nwDbEntry.RoceGidType
+	options[networkWaitReady] = nwDbEntry.WaitReady
+	options[networkGuidPool] = nwDbEntry.GuidPool
+	options[networkPkey] = nwDbEntry.Pkey
+	options[networkIPoIBMode] = nwDbEntry.IPoIBMode
+	options[networkBond] = nwDbEntry.Bond
+	options[networkSlaves] = nwDbEntry.Slaves
+	options[networkBondMode] = nwDbEntry.BondMode
+	options[networkPfPool] = nwDbEntry.PfPool
+	options[networkPfPolicy] = nwDbEntry.PfPolicy
+	options[networkNuma] = nwDbEntry.Numa
+	options[networkVfPolicy] = nwDbEntry.VfPolicy
+	options[networkVfs] = nwDbEntry.Vfs
+	options[networkReserve] = nwDbEntry.Reserve
+	options[networkMaxEndpoints] = nwDbEntry.MaxEndpoints
 	if nwDbEntry.Privileged {
 		options[networkPrivileged] = "1"
 	} else {
@@ -303,18 +555,77 @@ func (d *driver) CreatePersistentNetworks() error {
 
 		ipv4Data := network.IPAMData{}
 		ipv4Data.Gateway = n.Info.Gateway
+		ipv4Data.Pool = n.Info.Subnet
 
 		/* Create nw, but ignore the error.
 		 * This can happen when plugin is stopped and networks are
 		 * Deleted at the docker engine level, which plugin is
 		 * completely unaware of.
 		 */
-		_ = d._CreateNetwork(n.NetworkID, options, &ipv4Data, false)
+		err = d._CreateNetwork(n.NetworkID, options, &ipv4Data, false)
+		if err == nil {
+			d.RestorePersistentEndpoints(n.NetworkID)
+		}
 	}
 	return nil
 }
 
-func StartDriver() (*driver, error) {
+// RestorePersistentEndpoints hands the endpoints recorded for a network
+// back to the network, if it supports it.
+func (d *driver) RestorePersistentEndpoints(nid string) {
+	restorer, ok := d.networks[nid].(endpointRestorer)
+	if !ok {
+		return
+	}
+
+	eps, err := Read_Ep_Config_From_DB(nid)
+	if err != nil {
+		log.Printf("Fail to read endpoints of network %s: %v\n", nid, err)
+		return
+	}
+	for epID, dbEp := range eps {
+		err = restorer.RestoreEndpoint(epID, dbEp)
+		if err != nil {
+			log.Printf("Skipping and deleting stale endpoint %s: %v\n", epID, err)
+			Del_Ep_Config_From_DB(nid, epID)
+			continue
+		}
+		d.networks[nid].getGenNw().ndevEndpoints[epID].id = epID
+	}
+}
+
+func endpointToDb(endpoint *ptEndpoint) *DB_Endpoint {
+	dbEp := DB_Endpoint{
+		HwAddress: endpoint.HardwareAddr,
+		Address:   endpoint.Address,
+		DevName:   endpoint.devName,
+		VfIndex:   -1,
+		VfRepName: endpoint.vfRepName,
+		SfNum:     endpoint.sfNum,
+		SfPort:    endpoint.sfPort,
+		VdpaName:  endpoint.vdpaName,
+		VfioGroup: endpoint.vfioGroup,
+		VfDriver:  endpoint.vfDriver,
+		Pf:        endpoint.pf,
+		PkeyState: endpoint.pkeyState.toDb(),
+		RdmaState: endpoint.rdmaState.toDb(),
+	}
+	if endpoint.vfObj != nil {
+		dbEp.VfIndex = endpoint.vfObj.Index
+	}
+	if endpoint.guid != 0 {
+		dbEp.Guid = guidToHwAddr(endpoint.guid).String()
+	}
+	for _, slave := range endpoint.slaves {
+		dbEp.Slaves = append(dbEp.Slaves, *endpointToDb(slave))
+	}
+	for _, state := range endpoint.slaveStates {
+		dbEp.SlaveStates = append(dbEp.SlaveStates, state.toDb())
+	}
+	return &dbEp
+}
+
+func StartDriver(configFile string) (*driver, error) {
 
 	// allocate an empty map of network objects that can
 	// be later on referred by using id passed in CreateNetwork, DeleteNetwork
@@ -323,19 +634,50 @@ func StartDriver() (*driver, error) {
 	//dnetworks := make(map[string]interface{})
 	dnetworks := make(map[string]NwIface)
 
+	config, err := LoadDaemonConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	ipamDrv, err := newIpamDriver()
+	if err != nil {
+		return nil, err
+	}
+
 	driver := &driver{
 		networks: dnetworks,
+		ipam:     ipamDrv,
+		config:   config,
 	}
+	ipamDrv.driver = driver
 
-	err := driver.CreatePersistentNetworks()
+	err = driver.CreatePersistentNetworks()
 	if err != nil {
 		return nil, err
 	}
+	restoreDeferredPfConfigs(config)
 
 	return driver, nil
 }
 
+// endpointNumaNodes returns the NUMA nodes preferred for a new endpoint
+// when the network has a NUMA policy. Docker is asked without the driver
+// lock, so that other requests are served meanwhile.
+func (d *driver) endpointNumaNodes(r *network.CreateEndpointRequest) []int {
+	d.Lock()
+	genNw := d.getGenNwFromNetworkID(r.NetworkID)
+	if genNw == nil || genNw.numaPolicy == numaPolicyIgnore {
+		d.Unlock()
+		return nil
+	}
+	d.Unlock()
+
+	return startingContainerNumaNodes(r.NetworkID)
+}
+
 func (d *driver) CreateEndpoint(r *network.CreateEndpointRequest) (*network.CreateEndpointResponse, error) {
+	nodes := d.endpointNumaNodes(r)
+
 	d.Lock()
 	defer d.Unlock()
 
@@ -347,7 +689,27 @@ func (d *driver) CreateEndpoint(r *network.CreateEndpointRequest) (*network.Crea
 		return nil, fmt.Errorf("Plugin can not find network [ %s ].", r.NetworkID)
 	}
 
-	return nw.CreateEndpoint(r)
+	genNw := nw.getGenNw()
+	if genNw.maxEndpoints > 0 && len(genNw.ndevEndpoints) >= genNw.maxEndpoints {
+		return nil, fmt.Errorf("Network [ %s ] reached max_endpoints %d.", r.NetworkID, genNw.maxEndpoints)
+	}
+
+	genNw.numaNodes = nodes
+	resp, err := nw.CreateEndpoint(r)
+	genNw.numaNodes = nil
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := getEndpoint(nw.getGenNw(), r.EndpointID)
+	if endpoint != nil {
+		endpoint.id = r.EndpointID
+		err = Write_Ep_Config_to_DB(r.NetworkID, r.EndpointID, endpointToDb(endpoint))
+		if err != nil {
+			log.Printf("Fail to store endpoint %s: %v\n", r.EndpointID, err)
+		}
+	}
+	return resp, nil
 }
 
 func getEndpoint(genNw *genericNetwork, endpointID string) *ptEndpoint {
@@ -384,6 +746,11 @@ func (d *driver) EndpointInfo(r *network.InfoRequest) (*network.InfoResponse, er
 	value := make(map[string]string)
 	value["id"] = endpoint.id
 	value["srcName"] = endpoint.devName
+	if endpoint.vfioGroup != "" {
+		value["pciAddress"] = endpoint.vfObj.PciAddress
+		value["vfioGroup"] = endpoint.vfioGroup
+		value["macAddress"] = endpoint.HardwareAddr
+	}
 	resp := &network.InfoResponse{
 		Value: value,
 	}
@@ -391,9 +758,48 @@ func (d *driver) EndpointInfo(r *network.InfoRequest) (*network.InfoResponse, er
 	return resp, nil
 }
 
+// waitJoinReady waits for the netdevices of an endpoint to become ready
+// when the network has wait_ready. The driver lock is only held to look
+// the endpoint up, so that other requests are served meanwhile.
+func (d *driver) waitJoinReady(r *network.JoinRequest) error {
+	var targets []readyTarget
+
+	d.Lock()
+	genNw := d.getGenNwFromNetworkID(r.NetworkID)
+	if genNw == nil || genNw.waitReady == 0 || getEndpoint(genNw, r.EndpointID) == nil {
+		/* Join reports unknown endpoints */
+		d.Unlock()
+		return nil
+	}
+	timeout := genNw.waitReady
+	endpoint := getEndpoint(genNw, r.EndpointID)
+	if bondNw, ok := d.networks[r.NetworkID].(*bondSriovNetwork); ok && !bondNw.vfLag {
+		// bond of the VFs is brought up in the container
+		for i, slaveEp := range endpoint.slaves {
+			targets = append(targets, newReadyTarget(bondNw.slaves[i].genNw, slaveEp))
+		}
+	} else if endpoint.devName != "" {
+		targets = append(targets, newReadyTarget(genNw, endpoint))
+	}
+	d.Unlock()
+
+	for _, target := range targets {
+		err := waitEndpointReady(target, timeout)
+		if err != nil {
+			return fmt.Errorf("Endpoint %s: %v", r.EndpointID, err)
+		}
+	}
+	return nil
+}
+
 func (d *driver) Join(r *network.JoinRequest) (*network.JoinResponse, error) {
 	log.Printf("Join() [ %+v ]\n", r)
 
+	err := d.waitJoinReady(r)
+	if err != nil {
+		return nil, err
+	}
+
 	d.Lock()
 	defer d.Unlock()
 
@@ -414,7 +820,37 @@ func (d *driver) Join(r *network.JoinRequest) (*network.JoinResponse, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Parse gateway [%s] error: %s", genNw.IPv4Data.Gateway, err.Error())
 	}
+	// Metadata is collected while the devices are still in the host
+	// namespace.
+	meta := endpointMetadata(genNw, endpoint)
+	meta.SandboxKey = r.SandboxKey
+	// The sandbox key is only bound to the container namespace after Join,
+	// so the OCI hook moves the RDMA device once the container exists.
+	rdmaDev := ""
+	if genNw.rdmaNetns == rdmaNetnsExclusive && endpoint.devName != "" {
+		rdmaDev, err = rdmamap.GetRdmaDeviceForNetdevice(endpoint.devName)
+		if err != nil {
+			return nil, fmt.Errorf("Fail to find rdma device of %s: %v", endpoint.devName, err)
+		}
+		meta.RdmaDevice = rdmaDev
+		meta.RdmaNetns = genNw.rdmaNetns
+	}
+
+	err = writeEndpointMetadata(meta)
+	if err != nil && rdmaDev != "" {
+		// The hook can't move the rdma device without the metadata.
+		return nil, fmt.Errorf("Fail to write metadata of endpoint %s: %v", r.EndpointID, err)
+	}
+	if err != nil {
+		log.Printf("Fail to write metadata of endpoint %s: %v\n", r.EndpointID, err)
+	}
+
+	endpoint.rdmaDev = rdmaDev
 	endpoint.sandboxKey = r.SandboxKey
+	router := d.ipam.leaseJoined(genNw.ndevName, genNw.IPv4Data.Pool, endpoint.Address, r.SandboxKey)
+	if router != "" {
+		gw = net.ParseIP(router)
+	}
 	resp := network.JoinResponse{
 		InterfaceName: network.InterfaceName{
 			SrcName:   endpoint.devName,
@@ -423,6 +859,11 @@ func (d *driver) Join(r *network.JoinRequest) (*network.JoinResponse, error) {
 		DisableGatewayService: false,
 		Gateway:               gw.String(),
 	}
+	// Endpoints without a kernel netdevice, such as VFs bound to vfio-pci,
+	// have no interface in the sandbox to route through.
+	if endpoint.devName == "" {
+		resp.Gateway = ""
+	}
 
 	log.Printf("Join resp : [ %+v ]\n", resp)
 	return &resp, nil
@@ -443,7 +884,16 @@ func (d *driver) Leave(r *network.LeaveRequest) error {
 		return fmt.Errorf("Cannot find endpoint by id: %s", r.EndpointID)
 	}
 
+	if endpoint.rdmaDev != "" {
+		err := returnRdmaDevFromSandbox(endpoint.rdmaDev, endpoint.sandboxKey)
+		if err != nil {
+			log.Printf("Leave: %v\n", err)
+		}
+		endpoint.rdmaDev = ""
+	}
 	endpoint.sandboxKey = ""
+	d.ipam.leaseLeft(genNw.ndevName, genNw.IPv4Data.Pool, endpoint.Address)
+	removeEndpointMetadata(r.NetworkID, r.EndpointID)
 	return nil
 }
 
@@ -466,7 +916,9 @@ func (d *driver) DeleteEndpoint(r *network.DeleteEndpointRequest) error {
 	nw := d.networks[r.NetworkID]
 
 	nw.DeleteEndpoint(endpoint)
+	d.ipam.releaseEndpointLease(genNw.ndevName, genNw.IPv4Data.Pool, endpoint.Address)
 	delete(genNw.ndevEndpoints, r.EndpointID)
+	Del_Ep_Config_From_DB(r.NetworkID, r.EndpointID)
 	return nil
 }
 
@@ -493,9 +945,37 @@ func (d *driver) RevokeExternalConnectivity(r *network.RevokeExternalConnectivit
 func (pt *ptNetwork) CreateNetwork(d *driver, genNw *genericNetwork,
 	nid string, options map[string]string,
 	ipv4Data *network.IPAMData) error {
+	var err error
 
 	pt.genNw = genNw
 
+	if options[networkSlaves] != "" {
+		if options[networkDevice] != "" {
+			return fmt.Errorf("slaves and netdevice are exclusive")
+		}
+		if !genNw.rdmaTuning.isEmpty() || genNw.rdmaNetns != "" {
+			return fmt.Errorf("rdma settings are unsupported with slaves")
+		}
+		bondMode := options[networkBondMode]
+		if bondMode == "" {
+			bondMode = bondModeActiveBackup
+		}
+		pt.bondMode, err = parseBondMode(bondMode)
+		if err != nil {
+			return err
+		}
+		pt.slaves = strings.Split(options[networkSlaves], ",")
+		for _, slave := range pt.slaves {
+			link, err := netlink.LinkByName(slave)
+			if err != nil {
+				return fmt.Errorf("Fail to find slave %s: %v", slave, err)
+			}
+			if link.Attrs().MasterIndex != 0 {
+				return fmt.Errorf("slave %s is already enslaved", slave)
+			}
+		}
+	}
+
 	log.Printf("PT CreateNetwork : [%s] IPv4Data : [ %+v ]\n", pt.genNw.id, pt.genNw.IPv4Data)
 	return nil
 }
@@ -509,9 +989,33 @@ func (nw *ptNetwork) CreateEndpoint(r *network.CreateEndpointRequest) (*network.
 		return nil, fmt.Errorf("supports only one device")
 	}
 
+	rdmaState, err := nw.genNw.rdmaTuning.apply(nw.genNw.ndevName)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to apply rdma settings: %v", err)
+	}
+
 	ndev := &ptEndpoint{
-		devName: nw.genNw.ndevName,
-		Address: r.Interface.Address,
+		devName:   nw.genNw.ndevName,
+		Address:   r.Interface.Address,
+		rdmaState: rdmaState,
+	}
+
+	// slaves are restored to this state once the bond is dismantled
+	for _, slave := range nw.slaves {
+		state, err := saveLinkState(slave)
+		if err != nil {
+			rdmaState.revert()
+			return nil, fmt.Errorf("Fail to save state of slave %s: %v", slave, err)
+		}
+		ndev.slaveStates = append(ndev.slaveStates, state)
+	}
+	if len(nw.slaves) != 0 {
+		ndev.devName = endpointBondName(r.EndpointID)
+		err = createBond(ndev.devName, nw.slaves, nw.bondMode, "")
+		if err != nil {
+			nw.DeleteEndpoint(ndev)
+			return nil, err
+		}
 	}
 	nw.genNw.ndevEndpoints[r.EndpointID] = ndev
 
@@ -529,4 +1033,39 @@ func (nw *ptNetwork) CreateEndpoint(r *network.CreateEndpointRequest) (*network.
 
 func (nw *ptNetwork) DeleteEndpoint(endpoint *ptEndpoint) {
 
+	endpoint.rdmaState.revert()
+	if len(nw.slaves) != 0 && endpoint.devName != "" {
+		deleteBond(endpoint.devName)
+	}
+	for _, state := range endpoint.slaveStates {
+		err := state.restore()
+		if err != nil {
+			log.Printf("Fail to restore slave %s: %v\n", state.name, err)
+		}
+	}
+	endpoint.slaveStates = nil
+}
+
+// RestoreEndpoint takes over the endpoint created before the plugin
+// restarted, along with the state its slaves return to.
+func (nw *ptNetwork) RestoreEndpoint(id string, dbEp *DB_Endpoint) error {
+
+	endpoint := &ptEndpoint{
+		devName:   nw.genNw.ndevName,
+		Address:   dbEp.Address,
+		rdmaState: rdmaStateFromDb(dbEp.RdmaState),
+	}
+	if len(nw.slaves) != 0 {
+		endpoint.devName = dbEp.DevName
+	}
+	for i := range dbEp.SlaveStates {
+		state, err := linkStateFromDb(&dbEp.SlaveStates[i])
+		if err != nil {
+			return fmt.Errorf("Invalid state of slave %s: %v", dbEp.SlaveStates[i].Name, err)
+		}
+		endpoint.slaveStates = append(endpoint.slaveStates, state)
+	}
+	nw.genNw.ndevEndpoints[id] = endpoint
+	log.Printf("RestoreEndpoint [ %s ] netdevice: %s\n", id, endpoint.devName)
+	return nil
 }
@@ -5,12 +5,14 @@ import (
 	"github.com/docker/go-plugins-helpers/network"
 	"log"
 	"strconv"
+	"strings"
 )
 
 type dpSriovNetwork struct {
 	genNw      *genericNetwork
 	vlan       int
 	privileged int
+	allocator  vfAllocator
 }
 
 type dpPfDevice struct {
@@ -57,7 +59,16 @@ func (nw *dpSriovNetwork) CreateNetwork(d *driver, genNw *genericNetwork,
 	ndevName := options[networkDevice]
 
 	if IsSRIOVSupported(ndevName) == false {
-		return fmt.Errorf("SRIOV is unsuppported on %s", ndevName)
+		return fmt.Errorf("SRIOV is unsuppported on %s, vlan mode can be used instead", ndevName)
+	}
+	if options[networkEswitch] == eswitchModeSwitchdev {
+		return fmt.Errorf("switchdev mode is unsupported on multiport device %s", ndevName)
+	}
+	if options[networkNumVfs] != "" || options[networkInlineMode] != "" ||
+		options[networkEncapMode] != "" || options[networkGuidPool] != "" ||
+		options[networkPkey] != "" || options[networkVfs] != "" ||
+		options[networkReserve] != "" {
+		return fmt.Errorf("PF settings are unsupported on multiport device %s", ndevName)
 	}
 
 	if options[sriovVlan] != "" {
@@ -74,6 +85,15 @@ func (nw *dpSriovNetwork) CreateNetwork(d *driver, genNw *genericNetwork,
 	}
 	nw.privileged = privileged
 
+	// Without vf_policy the VF freed last is reused, as multiport
+	// networks always did.
+	if options[networkVfPolicy] != "" {
+		nw.allocator, err = newVfAllocator(options[networkVfPolicy])
+		if err != nil {
+			return err
+		}
+	}
+
 	nw.genNw = genNw
 
 	err = SetPFLinkUp(ndevName)
@@ -100,9 +120,12 @@ func (nw *dpSriovNetwork) CreateNetwork(d *driver, genNw *genericNetwork,
 
 func (nw *dpSriovNetwork) initSriovState(pfNetdevName string, dev *dpPfDevice) error {
 
-	var err error
+	deny, err := nw.genNw.driver.config.vfDenyList(pfNetdevName)
+	if err != nil {
+		return err
+	}
 
-	dev.childNetdevLlist, err = GetChildNetdevListByPort(pfNetdevName)
+	dev.childNetdevLlist, err = GetChildNetdevListByPort(pfNetdevName, deny)
 	if err != nil {
 		return err
 	}
@@ -138,9 +161,53 @@ func (nw *dpSriovNetwork) DiscoverVFs(ndevName string) error {
 	return nil
 }
 
-func (nw *dpSriovNetwork) AllocVF(parentNetdev string) string {
+// findBoundVF returns the position of the VF netdevice matching the address
+// binding in the free list.
+func (nw *dpSriovNetwork) findBoundVF(dev *dpPfDevice, binding *Db_Ipam_Binding) int {
+	for i, vfName := range dev.childNetdevLlist {
+		if binding.VfIndex >= 0 {
+			vfDir, err := FindVFDirForNetdev(nw.genNw.ndevName, vfName)
+			if err == nil && vfDir == netDevVFDevicePrefix+strconv.Itoa(binding.VfIndex) {
+				return i
+			}
+			continue
+		}
+		hwAddr, err := GetVFDefaultMacAddr(vfName)
+		if err == nil && hwAddr == binding.HwAddress {
+			return i
+		}
+	}
+	return -1
+}
+
+// pickVF returns the position in the free list of the VF netdevice chosen
+// by the VF policy of the network, or of the last one without a policy,
+// skipping the excluded VFs.
+func (nw *dpSriovNetwork) pickVF(dev *dpPfDevice, excluded map[int]bool) int {
+	var free []int
+	var positions []int
+
+	for i, vfName := range dev.childNetdevLlist {
+		index, err := vfIndexOfNetdev(nw.genNw.ndevName, vfName)
+		if err != nil || excluded[index] {
+			continue
+		}
+		free = append(free, index)
+		positions = append(positions, i)
+	}
+	if len(free) == 0 {
+		return -1
+	}
+	if nw.allocator == nil {
+		return positions[len(positions)-1]
+	}
+	return positions[nw.allocator.pick(nw.genNw.ndevName, free)]
+}
+
+func (nw *dpSriovNetwork) AllocVF(parentNetdev string, binding *Db_Ipam_Binding) string {
 	var allocatedDev string
 	var privileged bool
+	var pos int
 
 	if nw.privileged > 0 {
 		privileged = true
@@ -153,8 +220,21 @@ func (nw *dpSriovNetwork) AllocVF(parentNetdev string) string {
 		return ""
 	}
 
-	// fetch the last element
-	allocatedDev = dev.childNetdevLlist[len(dev.childNetdevLlist)-1]
+	// fetch the bound element or else the one of the VF policy
+	pos = -1
+	if binding != nil {
+		pos = nw.findBoundVF(dev, binding)
+		if pos < 0 && binding.Static {
+			return ""
+		}
+	}
+	if pos < 0 {
+		pos = nw.pickVF(dev, nil)
+		if pos < 0 {
+			return ""
+		}
+	}
+	allocatedDev = dev.childNetdevLlist[pos]
 	if allocatedDev == "" {
 		return ""
 	}
@@ -174,7 +254,7 @@ func (nw *dpSriovNetwork) AllocVF(parentNetdev string) string {
 		return ""
 	}
 
-	dev.childNetdevLlist = dev.childNetdevLlist[:len(dev.childNetdevLlist)-1]
+	dev.childNetdevLlist = append(dev.childNetdevLlist[:pos], dev.childNetdevLlist[pos+1:]...)
 
 	log.Printf("AllocVF parent [ %+v ] vf:%v vfdev: %v\n",
 		parentNetdev, allocatedDev, len(dev.childNetdevLlist))
@@ -184,19 +264,41 @@ func (nw *dpSriovNetwork) AllocVF(parentNetdev string) string {
 func (nw *dpSriovNetwork) FreeVF(pf *dpPfDevice, vfName string) {
 	log.Printf("FreeVF %v\n", vfName)
 	pf.childNetdevLlist = append(pf.childNetdevLlist, vfName)
+	index, err := vfIndexOfNetdev(nw.genNw.ndevName, vfName)
+	if err == nil {
+		recordVfRelease(nw.genNw.ndevName, index)
+	}
 }
 
 func (nw *dpSriovNetwork) CreateEndpoint(r *network.CreateEndpointRequest) (*network.CreateEndpointResponse, error) {
 	var netdevName string
 
-	netdevName = nw.AllocVF(nw.genNw.ndevName)
+	binding := nw.genNw.driver.ipam.lookupBinding(nw.genNw.ndevName,
+		nw.genNw.IPv4Data.Pool, r.Interface.Address)
+
+	netdevName = nw.AllocVF(nw.genNw.ndevName, binding)
 	if netdevName == "" {
 		return nil, fmt.Errorf("All devices in use [ %s ].", r.NetworkID)
 	}
+	rdmaState, err := nw.genNw.rdmaTuning.apply(netdevName)
+	if err != nil {
+		nw.FreeVF(dpPfDevices[nw.genNw.ndevName], netdevName)
+		return nil, fmt.Errorf("Fail to apply rdma settings: %v", err)
+	}
+	if binding == nil || !binding.Static {
+		vfDir, _ := FindVFDirForNetdev(nw.genNw.ndevName, netdevName)
+		vfIndex, err := strconv.Atoi(strings.TrimPrefix(vfDir, netDevVFDevicePrefix))
+		if err == nil {
+			hwAddr, _ := GetVFDefaultMacAddr(netdevName)
+			nw.genNw.driver.ipam.learnBinding(nw.genNw.ndevName, nw.genNw.IPv4Data.Pool,
+				r.Interface.Address, vfIndex, hwAddr)
+		}
+	}
 	ndev := &ptEndpoint{
-		devName: netdevName,
-		vfName:  netdevName,
-		Address: r.Interface.Address,
+		devName:   netdevName,
+		vfName:    netdevName,
+		Address:   r.Interface.Address,
+		rdmaState: rdmaState,
 	}
 	nw.genNw.ndevEndpoints[r.EndpointID] = ndev
 
@@ -217,6 +319,7 @@ func (nw *dpSriovNetwork) DeleteEndpoint(endpoint *ptEndpoint) {
 
 	dev := dpPfDevices[nw.genNw.ndevName]
 
+	endpoint.rdmaState.revert()
 	nw.FreeVF(dev, endpoint.vfName)
 	log.Printf("DeleteEndpoint vfDev list length ----------: [ %+d ]\n", len(dev.childNetdevLlist))
 }
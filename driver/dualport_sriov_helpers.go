@@ -2,6 +2,7 @@ package driver
 
 import (
 	"fmt"
+	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -105,7 +106,9 @@ func findPhyPort(netdevName string) int {
 	return port
 }
 
-func GetChildNetdevListByPort(netdevName string) ([]string, error) {
+// GetChildNetdevListByPort returns the VF netdevices of the port of the
+// netdevice, except VFs on the deny list.
+func GetChildNetdevListByPort(netdevName string, deny *vfDenyList) ([]string, error) {
 	var netdevList []string
 	var port int
 
@@ -118,6 +121,7 @@ func GetChildNetdevListByPort(netdevName string) ([]string, error) {
 	if npMap == nil {
 		return nil, fmt.Errorf("fail to build port netdevice map")
 	}
+	adminMacs := pfVfAdminMacs(netdevName)
 
 	for _, entry := range npMap {
 		/* ignore if the port is not matching */
@@ -133,6 +137,10 @@ func GetChildNetdevListByPort(netdevName string) ([]string, error) {
 		if vfDir == "" || err != nil {
 			continue
 		}
+		if deny.isVfDenied(netdevName, vfDir, adminMacs) {
+			log.Printf("Skipping denied vf netdevice %s\n", entry.ndevName)
+			continue
+		}
 		netdevList = append(netdevList, entry.ndevName)
 	}
 	fmt.Println("ndev list lengh = ", len(netdevList))
@@ -0,0 +1,154 @@
+package driver
+
+import (
+	"encoding/json"
+	"github.com/Mellanox/rdmamap"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// Directory of per endpoint files which containers can bind mount
+	endpointRunDir = "/run/docker-sriov-plugin"
+)
+
+/* Per endpoint metadata file, <endpointRunDir>/<nid>/<endpointid>.json
+{
+	"NetworkID": "...",
+	"EndpointID": "...",
+	"Mode": "sriov",
+	"Pf": "ens2f0",
+	"VfIndex": 3,
+	"PciAddress": "0000:05:00.5",
+	"Netdevice": "ens2f0v3",
+	"MacAddress": "ce:d0:9a:3f:16:0b",
+	"RdmaDevice": "mlx5_5",
+	"RdmaCharDevices": ["/dev/infiniband/uverbs5", "/dev/infiniband/rdma_cm"],
+	"RdmaNetns": "exclusive",
+	"NumaNode": 0,
+	"Numa": "strict",
+	"SandboxKey": "/var/run/docker/netns/0c2f1a2b3c4d",
+	"Address": "194.168.1.5/24",
+	"WaitReady": "5s"
+}
+*/
+
+/* Endpoint metadata published to containers */
+type Endpoint_Metadata struct {
+	NetworkID  string `json:"NetworkID"`
+	EndpointID string `json:"EndpointID"`
+	Mode       string `json:"Mode"`
+	Pf         string `json:"Pf"`
+	VfIndex    int    `json:"VfIndex"`
+	PciAddress string `json:"PciAddress"`
+	Netdevice  string `json:"Netdevice,omitempty"`
+	HwAddress  string `json:"MacAddress,omitempty"`
+	RdmaDevice string `json:"RdmaDevice,omitempty"`
+	NumaNode   int    `json:"NumaNode"`
+	Numa       string `json:"Numa,omitempty"` // NUMA policy of the network
+	VfioGroup  string `json:"VfioGroup,omitempty"`
+	SandboxKey string `json:"SandboxKey"`
+	Address    string `json:"Address,omitempty"`
+	WaitReady  string `json:"WaitReady,omitempty"`
+	Guid       string `json:"Guid,omitempty"`
+	RdmaNetns  string `json:"RdmaNetns,omitempty"`
+
+	RdmaCharDevices []string `json:"RdmaCharDevices,omitempty"`
+}
+
+func endpointFilePath(nid string, endpointID string) string {
+	return filepath.Join(endpointRunDir, nid, endpointID+".json")
+}
+
+func pciDevNumaNode(pciAddr string) int {
+	numaFile := fileObject{
+		Path: filepath.Join(pciDevicesDir, pciAddr, "numa_node"),
+	}
+	node, err := numaFile.ReadInt()
+	if err != nil {
+		return -1
+	}
+	return node
+}
+
+// endpointMetadata describes the device given to an endpoint. It has to
+// be built while the netdevice is still in the host namespace.
+func endpointMetadata(genNw *genericNetwork, endpoint *ptEndpoint) *Endpoint_Metadata {
+	meta := Endpoint_Metadata{
+		NetworkID:  genNw.id,
+		EndpointID: endpoint.id,
+		Mode:       genNw.mode,
+		Pf:         genNw.ndevName,
+		VfIndex:    -1,
+		Netdevice:  endpoint.devName,
+		HwAddress:  endpoint.HardwareAddr,
+		VfioGroup:  endpoint.vfioGroup,
+		Address:    endpoint.Address,
+	}
+	if endpoint.pf != "" {
+		meta.Pf = endpoint.pf
+	}
+	if genNw.waitReady > 0 {
+		meta.WaitReady = genNw.waitReady.String()
+	}
+	if genNw.numaPolicy != numaPolicyIgnore {
+		meta.Numa = genNw.numaPolicy
+	}
+	if endpoint.guid != 0 {
+		meta.Guid = guidToHwAddr(endpoint.guid).String()
+	}
+
+	if endpoint.vfObj != nil {
+		meta.VfIndex = endpoint.vfObj.Index
+		meta.PciAddress = endpoint.vfObj.PciAddress
+	} else if endpoint.devName != "" {
+		meta.PciAddress, _ = netdevPciAddress(endpoint.devName)
+	}
+	if meta.HwAddress == "" && endpoint.devName != "" {
+		meta.HwAddress, _ = GetVFDefaultMacAddr(endpoint.devName)
+	}
+
+	if endpoint.devName != "" {
+		meta.RdmaDevice, _ = rdmamap.GetRdmaDeviceForNetdevice(endpoint.devName)
+	}
+	if meta.RdmaDevice == "" && meta.PciAddress != "" {
+		rdmaDevs := rdmamap.GetRdmaDevicesForPcidev(meta.PciAddress)
+		if len(rdmaDevs) != 0 {
+			meta.RdmaDevice = rdmaDevs[0]
+		}
+	}
+	if meta.RdmaDevice != "" {
+		for _, devPath := range rdmamap.GetRdmaCharDevices(meta.RdmaDevice) {
+			if isRdmaAppDevice(devPath) {
+				meta.RdmaCharDevices = append(meta.RdmaCharDevices, devPath)
+			}
+		}
+	}
+
+	meta.NumaNode = -1
+	if meta.PciAddress != "" {
+		meta.NumaNode = pciDevNumaNode(meta.PciAddress)
+	}
+	return &meta
+}
+
+func writeEndpointMetadata(meta *Endpoint_Metadata) error {
+	path := endpointFilePath(meta.NetworkID, meta.EndpointID)
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(meta, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func removeEndpointMetadata(nid string, endpointID string) {
+	os.Remove(endpointFilePath(nid, endpointID))
+	/* remove network directory once its last endpoint left */
+	os.Remove(filepath.Join(endpointRunDir, nid))
+}
@@ -5,10 +5,12 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 const (
-	persistConfigPath = "/etc/docker/mellanox/docker-sriov-plugin"
+	persistConfigPath   = "/etc/docker/mellanox/docker-sriov-plugin"
+	persistPfConfigPath = "/etc/docker/mellanox/docker-sriov-plugin-pf"
 )
 
 /* Configuration layout
@@ -32,12 +34,79 @@ type Db_Network_Info struct {
 	Gateway    string `json:"Gateway"`
 	Vlan       int    `json:"vlan"`
 	Privileged bool   `json:"Privileged"`
+	Eswitch    string `json:"Eswitch"`
+	Bridge     string `json:"Bridge"`
+	BridgeType string `json:"BridgeType"`
+	Acl        string `json:"Acl"`
+	NumVfs     int    `json:"NumVfs"`
+	InlineMode string `json:"InlineMode"`
+	EncapMode  string `json:"EncapMode"`
+	SfRate     string `json:"SfRate"`
+	RdmaNetns  string `json:"RdmaNetns"`
+
+	RoceHopLimit string `json:"RoceHopLimit"`
+	RoceTos      string `json:"RoceTos"`
+	RoceGidType  string `json:"RoceGidType"`
+	WaitReady    string `json:"WaitReady"`
+	GuidPool     string `json:"GuidPool"`
+	Pkey         string `json:"Pkey"`
+	IPoIBMode    string `json:"IPoIBMode"`
+	Bond         string `json:"Bond"`
+	Slaves       string `json:"Slaves"`
+	BondMode     string `json:"BondMode"`
+	PfPool       string `json:"PfPool"`
+	PfPolicy     string `json:"PfPolicy"`
+	Numa         string `json:"Numa"`
+	VfPolicy     string `json:"VfPolicy"`
+	Vfs          string `json:"Vfs"`
+	Reserve      string `json:"Reserve"`
+	MaxEndpoints string `json:"MaxEndpoints"`
 }
 
-/* Endpoint config.json */
+/* Endpoint ep.json */
 type DB_Endpoint struct {
 	Version   uint32 `json:"Version"`
 	HwAddress string `json:"Hw_Address"`
+	Address   string `json:"Address"`
+	DevName   string `json:"Devname"`
+	VfIndex   int    `json:"VfIndex"`
+	VfRepName string `json:"VfRepresentor"`
+	SfNum     int    `json:"SfNum"`
+	SfPort    string `json:"SfPort"`
+	VdpaName  string `json:"VdpaName"`
+	VfioGroup string `json:"VfioGroup"`
+	VfDriver  string `json:"VfDriver"`
+	Guid      string `json:"Guid"`
+	Pf        string `json:"Pf"`
+
+	PkeyState *DB_Rdma_State `json:"PkeyState,omitempty"`
+	RdmaState *DB_Rdma_State `json:"RdmaState,omitempty"`
+
+	SlaveStates []DB_Link_State `json:"SlaveStates,omitempty"`
+
+	Slaves []DB_Endpoint `json:"Slaves"`
+}
+
+// DB_Rdma_State records the RDMA attributes changed for an endpoint and
+// their previous values.
+type DB_Rdma_State struct {
+	PrevAttrs []DB_Rdma_Attr `json:"PrevAttrs"`
+	CmDirs    []string       `json:"CmDirs"`
+}
+
+type DB_Rdma_Attr struct {
+	Path  string `json:"Path"`
+	Value string `json:"Value"`
+}
+
+// DB_Link_State records the configuration of a slave netdevice to restore
+// when its bond is dismantled.
+type DB_Link_State struct {
+	Name      string   `json:"Name"`
+	Up        bool     `json:"Up"`
+	Mtu       int      `json:"Mtu"`
+	HwAddress string   `json:"Hw_Address"`
+	Addresses []string `json:"Addresses"`
 }
 
 type Db_Network struct {
@@ -131,3 +200,107 @@ func Read_Past_Config(configDir string) ([]*Db_Network, error) {
 	}
 	return nwList, nil
 }
+
+func Write_Ep_Config_to_DB(nwKey string, epKey string, ep *DB_Endpoint) error {
+	rawData, err := json.Marshal(ep)
+	if err != nil {
+		return err
+	}
+
+	nwDir := filepath.Join(persistConfigPath, nwKey)
+	err = createDir(nwDir)
+	if err != nil {
+		return err
+	}
+
+	epFile := filepath.Join(nwDir, epKey+".json")
+	err = ioutil.WriteFile(epFile, rawData, os.FileMode(0644))
+	return err
+}
+
+func Del_Ep_Config_From_DB(nwKey string, epKey string) error {
+
+	epFile := filepath.Join(persistConfigPath, nwKey, epKey+".json")
+	os.Remove(epFile)
+	return nil
+}
+
+func Read_Ep_Config_From_DB(nwKey string) (map[string]*DB_Endpoint, error) {
+	eps := make(map[string]*DB_Endpoint)
+
+	nwDir := filepath.Join(persistConfigPath, nwKey)
+	files, err := lsFilesWithPrefix(nwDir, ".json", true)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if file == "config.json" {
+			continue
+		}
+		rawData, err2 := ioutil.ReadFile(filepath.Join(nwDir, file))
+		if err2 != nil {
+			return nil, err2
+		}
+		ep := DB_Endpoint{}
+		err = json.Unmarshal(rawData, &ep)
+		if err != nil {
+			return nil, err
+		}
+		eps[strings.TrimSuffix(file, ".json")] = &ep
+	}
+	return eps, nil
+}
+
+/* Settings of a PF before the plugin configured it, pf/<netdev>.json */
+func Write_Pf_Config_to_DB(pfKey string, cfg *Daemon_Pf_Config) error {
+	rawData, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+
+	err = createDir(persistPfConfigPath)
+	if err != nil {
+		return err
+	}
+
+	pfFile := filepath.Join(persistPfConfigPath, pfKey+".json")
+	err = ioutil.WriteFile(pfFile, rawData, os.FileMode(0644))
+	return err
+}
+
+func Read_Pf_Config_From_DB(pfKey string) (*Daemon_Pf_Config, error) {
+
+	pfFile := filepath.Join(persistPfConfigPath, pfKey+".json")
+	rawData, err := ioutil.ReadFile(pfFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := Daemon_Pf_Config{}
+	err = json.Unmarshal(rawData, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func Read_Pf_Config_List_From_DB() ([]string, error) {
+	var pfKeys []string
+
+	files, err := lsFilesWithPrefix(persistPfConfigPath, ".json", true)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		pfKeys = append(pfKeys, strings.TrimSuffix(file, ".json"))
+	}
+	return pfKeys, nil
+}
+
+func Del_Pf_Config_From_DB(pfKey string) error {
+
+	pfFile := filepath.Join(persistPfConfigPath, pfKey+".json")
+	os.Remove(pfFile)
+	return nil
+}
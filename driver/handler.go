@@ -0,0 +1,201 @@
+package driver
+
+import (
+	"github.com/docker/go-plugins-helpers/ipam"
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/go-plugins-helpers/sdk"
+	"net/http"
+)
+
+const (
+	pluginManifest = `{"Implements": ["NetworkDriver", "IpamDriver"]}`
+
+	networkCapabilitiesPath = "/NetworkDriver.GetCapabilities"
+	createNetworkPath       = "/NetworkDriver.CreateNetwork"
+	allocateNetworkPath     = "/NetworkDriver.AllocateNetwork"
+	deleteNetworkPath       = "/NetworkDriver.DeleteNetwork"
+	freeNetworkPath         = "/NetworkDriver.FreeNetwork"
+	createEndpointPath      = "/NetworkDriver.CreateEndpoint"
+	endpointInfoPath        = "/NetworkDriver.EndpointOperInfo"
+	deleteEndpointPath      = "/NetworkDriver.DeleteEndpoint"
+	joinPath                = "/NetworkDriver.Join"
+	leavePath               = "/NetworkDriver.Leave"
+	discoverNewPath         = "/NetworkDriver.DiscoverNew"
+	discoverDeletePath      = "/NetworkDriver.DiscoverDelete"
+	programExtConnPath      = "/NetworkDriver.ProgramExternalConnectivity"
+	revokeExtConnPath       = "/NetworkDriver.RevokeExternalConnectivity"
+
+	ipamCapabilitiesPath = "/IpamDriver.GetCapabilities"
+	addressSpacesPath    = "/IpamDriver.GetDefaultAddressSpaces"
+	requestPoolPath      = "/IpamDriver.RequestPool"
+	releasePoolPath      = "/IpamDriver.ReleasePool"
+	requestAddressPath   = "/IpamDriver.RequestAddress"
+	releaseAddressPath   = "/IpamDriver.ReleaseAddress"
+)
+
+type errorResponse struct {
+	Err string
+}
+
+func respond(w http.ResponseWriter, res interface{}, err error) {
+	if err != nil {
+		sdk.EncodeResponse(w, &errorResponse{Err: err.Error()}, true)
+		return
+	}
+	if res == nil {
+		res = struct{}{}
+	}
+	sdk.EncodeResponse(w, res, false)
+}
+
+// NewHandler returns a plugin handler which serves both the network
+// driver and the IPAM driver API of the plugin on a single socket.
+func NewHandler(d *driver) sdk.Handler {
+	h := sdk.NewHandler(pluginManifest)
+	initNetworkMux(h, d)
+	initIpamMux(h, d.ipam)
+	return h
+}
+
+func initNetworkMux(h sdk.Handler, d *driver) {
+	h.HandleFunc(networkCapabilitiesPath, func(w http.ResponseWriter, r *http.Request) {
+		res, err := d.GetCapabilities()
+		respond(w, res, err)
+	})
+	h.HandleFunc(createNetworkPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &network.CreateNetworkRequest{}
+		if sdk.DecodeRequest(w, r, req) != nil {
+			return
+		}
+		respond(w, nil, d.CreateNetwork(req))
+	})
+	h.HandleFunc(allocateNetworkPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &network.AllocateNetworkRequest{}
+		if sdk.DecodeRequest(w, r, req) != nil {
+			return
+		}
+		res, err := d.AllocateNetwork(req)
+		respond(w, res, err)
+	})
+	h.HandleFunc(deleteNetworkPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &network.DeleteNetworkRequest{}
+		if sdk.DecodeRequest(w, r, req) != nil {
+			return
+		}
+		respond(w, nil, d.DeleteNetwork(req))
+	})
+	h.HandleFunc(freeNetworkPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &network.FreeNetworkRequest{}
+		if sdk.DecodeRequest(w, r, req) != nil {
+			return
+		}
+		respond(w, nil, d.FreeNetwork(req))
+	})
+	h.HandleFunc(createEndpointPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &network.CreateEndpointRequest{}
+		if sdk.DecodeRequest(w, r, req) != nil {
+			return
+		}
+		res, err := d.CreateEndpoint(req)
+		respond(w, res, err)
+	})
+	h.HandleFunc(endpointInfoPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &network.InfoRequest{}
+		if sdk.DecodeRequest(w, r, req) != nil {
+			return
+		}
+		res, err := d.EndpointInfo(req)
+		respond(w, res, err)
+	})
+	h.HandleFunc(deleteEndpointPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &network.DeleteEndpointRequest{}
+		if sdk.DecodeRequest(w, r, req) != nil {
+			return
+		}
+		respond(w, nil, d.DeleteEndpoint(req))
+	})
+	h.HandleFunc(joinPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &network.JoinRequest{}
+		if sdk.DecodeRequest(w, r, req) != nil {
+			return
+		}
+		res, err := d.Join(req)
+		respond(w, res, err)
+	})
+	h.HandleFunc(leavePath, func(w http.ResponseWriter, r *http.Request) {
+		req := &network.LeaveRequest{}
+		if sdk.DecodeRequest(w, r, req) != nil {
+			return
+		}
+		respond(w, nil, d.Leave(req))
+	})
+	h.HandleFunc(discoverNewPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &network.DiscoveryNotification{}
+		if sdk.DecodeRequest(w, r, req) != nil {
+			return
+		}
+		respond(w, nil, d.DiscoverNew(req))
+	})
+	h.HandleFunc(discoverDeletePath, func(w http.ResponseWriter, r *http.Request) {
+		req := &network.DiscoveryNotification{}
+		if sdk.DecodeRequest(w, r, req) != nil {
+			return
+		}
+		respond(w, nil, d.DiscoverDelete(req))
+	})
+	h.HandleFunc(programExtConnPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &network.ProgramExternalConnectivityRequest{}
+		if sdk.DecodeRequest(w, r, req) != nil {
+			return
+		}
+		respond(w, nil, d.ProgramExternalConnectivity(req))
+	})
+	h.HandleFunc(revokeExtConnPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &network.RevokeExternalConnectivityRequest{}
+		if sdk.DecodeRequest(w, r, req) != nil {
+			return
+		}
+		respond(w, nil, d.RevokeExternalConnectivity(req))
+	})
+}
+
+func initIpamMux(h sdk.Handler, i *ipamDriver) {
+	h.HandleFunc(ipamCapabilitiesPath, func(w http.ResponseWriter, r *http.Request) {
+		res, err := i.GetCapabilities()
+		respond(w, res, err)
+	})
+	h.HandleFunc(addressSpacesPath, func(w http.ResponseWriter, r *http.Request) {
+		res, err := i.GetDefaultAddressSpaces()
+		respond(w, res, err)
+	})
+	h.HandleFunc(requestPoolPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &ipam.RequestPoolRequest{}
+		if sdk.DecodeRequest(w, r, req) != nil {
+			return
+		}
+		res, err := i.RequestPool(req)
+		respond(w, res, err)
+	})
+	h.HandleFunc(releasePoolPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &ipam.ReleasePoolRequest{}
+		if sdk.DecodeRequest(w, r, req) != nil {
+			return
+		}
+		respond(w, nil, i.ReleasePool(req))
+	})
+	h.HandleFunc(requestAddressPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &ipam.RequestAddressRequest{}
+		if sdk.DecodeRequest(w, r, req) != nil {
+			return
+		}
+		res, err := i.RequestAddress(req)
+		respond(w, res, err)
+	})
+	h.HandleFunc(releaseAddressPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &ipam.ReleaseAddressRequest{}
+		if sdk.DecodeRequest(w, r, req) != nil {
+			return
+		}
+		respond(w, nil, i.ReleaseAddress(req))
+	})
+}
@@ -0,0 +1,165 @@
+package driver
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	netdevTypeFile     = "type"
+	arphrdInfiniband   = 32
+	guidLen            = 8
+	endpointGuidDigits = 2 * guidLen
+)
+
+// guidPool hands out VF GUIDs from a range given per network.
+type guidPool struct {
+	start uint64
+	end   uint64
+	used  map[uint64]bool
+}
+
+func parseGuid(value string) (uint64, error) {
+	hwAddr, err := net.ParseMAC(value)
+	if err != nil || len(hwAddr) != guidLen {
+		return 0, fmt.Errorf("Invalid guid %s", value)
+	}
+	return binary.BigEndian.Uint64(hwAddr), nil
+}
+
+func guidToHwAddr(guid uint64) net.HardwareAddr {
+	hwAddr := make(net.HardwareAddr, guidLen)
+	binary.BigEndian.PutUint64(hwAddr, guid)
+	return hwAddr
+}
+
+// parseGuidPool parses a GUID range such as
+// 02:00:00:00:00:00:00:01-02:00:00:00:00:00:00:ff.
+func parseGuidPool(value string) (*guidPool, error) {
+	var err error
+
+	bounds := strings.SplitN(value, "-", 2)
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("Invalid guid_pool %s, valid format is start-end", value)
+	}
+	pool := guidPool{used: make(map[uint64]bool)}
+	pool.start, err = parseGuid(bounds[0])
+	if err != nil {
+		return nil, err
+	}
+	pool.end, err = parseGuid(bounds[1])
+	if err != nil {
+		return nil, err
+	}
+	if pool.start == 0 || pool.start > pool.end {
+		return nil, fmt.Errorf("Invalid guid_pool %s", value)
+	}
+	return &pool, nil
+}
+
+func (pool *guidPool) overlaps(other *guidPool) bool {
+	return pool.start <= other.end && other.start <= pool.end
+}
+
+// checkGuidPoolNwExist tells whether a network of the PF has a guid_pool
+// overlapping the pool, whose GUIDs would be given to two VFs.
+func checkGuidPoolNwExist(pfNetdevName string, pool *guidPool) bool {
+	for _, nw := range networks {
+		if nw.guidPool != nil && nw.guidPool.overlaps(pool) &&
+			nw.genNw.ndevName == pfNetdevName {
+			return true
+		}
+	}
+	return false
+}
+
+func (pool *guidPool) alloc() (uint64, error) {
+	for guid := pool.start; guid <= pool.end && guid != 0; guid++ {
+		if !pool.used[guid] {
+			pool.used[guid] = true
+			return guid, nil
+		}
+	}
+	return 0, fmt.Errorf("All guids of the pool are in use")
+}
+
+func (pool *guidPool) reserve(guid uint64) {
+	if guid >= pool.start && guid <= pool.end {
+		pool.used[guid] = true
+	}
+}
+
+func (pool *guidPool) free(guid uint64) {
+	delete(pool.used, guid)
+}
+
+// guidFromEndpoint derives a stable GUID from the endpoint id.
+func guidFromEndpoint(endpointID string) uint64 {
+	var guid uint64
+
+	if len(endpointID) >= endpointGuidDigits {
+		raw, err := hex.DecodeString(endpointID[:endpointGuidDigits])
+		if err == nil {
+			guid = binary.BigEndian.Uint64(raw)
+		}
+	}
+	if guid == 0 {
+		guid = 1
+	}
+	return guid
+}
+
+func isIBNetdev(netdevName string) bool {
+	typeFile := fileObject{
+		Path: filepath.Join(netSysDir, netdevName, netdevTypeFile),
+	}
+	linkType, err := typeFile.ReadInt()
+	return err == nil && linkType == arphrdInfiniband
+}
+
+// setVfGuid sets node and port GUID of a VF. A zero GUID clears them.
+func setVfGuid(pfNetdevName string, vfIndex int, guid uint64) error {
+	pfLink, err := netlink.LinkByName(pfNetdevName)
+	if err != nil {
+		return err
+	}
+
+	hwAddr := guidToHwAddr(guid)
+	err = netlink.LinkSetVfNodeGUID(pfLink, vfIndex, hwAddr)
+	if err != nil {
+		return fmt.Errorf("Fail to set node guid of vf %d: %v", vfIndex, err)
+	}
+	err = netlink.LinkSetVfPortGUID(pfLink, vfIndex, hwAddr)
+	if err != nil {
+		return fmt.Errorf("Fail to set port guid of vf %d: %v", vfIndex, err)
+	}
+	return nil
+}
+
+// assignVfGuid sets the GUIDs of a VF and rebinds the VF driver so that
+// they take effect.
+func assignVfGuid(pfNetdevName string, vfIndex int, vfPciAddr string, guid uint64) error {
+	err := setVfGuid(pfNetdevName, vfIndex, guid)
+	if err != nil {
+		return err
+	}
+	if pciDevDriver(vfPciAddr) == "" {
+		return nil
+	}
+	err = unbindVF(pfNetdevName, vfPciAddr)
+	if err != nil {
+		return err
+	}
+	err = bindVF(pfNetdevName, vfPciAddr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Assigned guid %s to vf %d of %s\n", guidToHwAddr(guid), vfIndex, pfNetdevName)
+	return nil
+}
@@ -0,0 +1,105 @@
+package driver
+
+import (
+	"fmt"
+	"github.com/Mellanox/rdmamap"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	pkeyPartitionMask = 0x7fff
+	pkeyIdxNone       = "none"
+)
+
+func parsePkey(value string) (uint16, error) {
+	pkey, err := strconv.ParseUint(value, 0, 16)
+	if err != nil || pkey&pkeyPartitionMask == 0 {
+		return 0, fmt.Errorf("Invalid pkey %s", value)
+	}
+	return uint16(pkey), nil
+}
+
+func checkPkeyNwExist(pfNetdevName string, pkey uint16) bool {
+	if pkey == 0 {
+		return false
+	}
+
+	for _, nw := range networks {
+		if nw.pkey&pkeyPartitionMask == pkey&pkeyPartitionMask &&
+			nw.genNw.ndevName == pfNetdevName {
+			return true
+		}
+	}
+	return false
+}
+
+// findPfPkeyIndex returns the index of the pkey in the pkey table of a PF
+// port, which is programmed by the subnet manager.
+func findPfPkeyIndex(pfRdmaDev string, port string, pkey uint16) (string, error) {
+	pkeysDir := filepath.Join(rdmamap.RdmaClassDir, pfRdmaDev, "ports", port, "pkeys")
+
+	indexes, err := lsDirs(pkeysDir)
+	if err != nil {
+		return "", err
+	}
+	for _, index := range indexes {
+		pkeyFile := fileObject{
+			Path: filepath.Join(pkeysDir, index),
+		}
+		value, err := pkeyFile.Read()
+		if err != nil {
+			continue
+		}
+		entry, err := strconv.ParseUint(strings.TrimSpace(value), 0, 16)
+		if err == nil && uint16(entry) == pkey {
+			return index, nil
+		}
+	}
+	return "", fmt.Errorf("pkey 0x%04x is not in the pkey table of %s port %s", pkey, pfRdmaDev, port)
+}
+
+// applyVfPkey maps the VF pkey table to the single partition of the
+// network: VF pkey index 0 maps to the partition and other indexes are
+// unmapped. Previous mappings are recorded in the returned state.
+func applyVfPkey(pfNetdevName string, vfPciAddr string, pkey uint16) (*rdmaTuningState, error) {
+
+	pfRdmaDev, err := rdmamap.GetRdmaDeviceForNetdevice(pfNetdevName)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to find rdma device of %s: %v", pfNetdevName, err)
+	}
+	iovPortsDir := filepath.Join(rdmamap.RdmaClassDir, pfRdmaDev, "iov", vfPciAddr, "ports")
+	ports, err := lsDirs(iovPortsDir)
+	if err != nil {
+		return nil, fmt.Errorf("pkey is unsupported by %s: %v", pfRdmaDev, err)
+	}
+
+	state := &rdmaTuningState{}
+	for _, port := range ports {
+		pfIndex, err := findPfPkeyIndex(pfRdmaDev, port, pkey)
+		if err != nil {
+			state.revert()
+			return nil, err
+		}
+
+		pkeyIdxDir := filepath.Join(iovPortsDir, port, "pkey_idx")
+		vfIndexes, err := lsDirs(pkeyIdxDir)
+		if err != nil {
+			state.revert()
+			return nil, err
+		}
+		for _, vfIndex := range vfIndexes {
+			value := pkeyIdxNone
+			if vfIndex == "0" {
+				value = pfIndex
+			}
+			err = state.writeAttr(filepath.Join(pkeyIdxDir, vfIndex), value)
+			if err != nil {
+				state.revert()
+				return nil, fmt.Errorf("Fail to set pkey index %s of vf %s: %v", vfIndex, vfPciAddr, err)
+			}
+		}
+	}
+	return state, nil
+}
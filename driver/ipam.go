@@ -0,0 +1,481 @@
+package driver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/docker/go-plugins-helpers/ipam"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	ipamAddressSpace = "sriov"
+
+	ipamReserved = "reserved" // --ipam-opt reserved=ip[-ip],...
+	ipamBind     = "bind"     // --ipam-opt bind=ip@vfN|ip@mac,...
+
+	ipamRequestAddressType = "RequestAddressType"
+	ipamGatewayAddressType = "com.docker.network.gateway"
+
+	ipamBindVfPrefix = "vf"
+)
+
+type ipRange struct {
+	start uint32
+	end   uint32
+}
+
+type ipamPool struct {
+	id        string
+	subnet    *net.IPNet
+	subPool   *net.IPNet
+	reserved  []ipRange
+	allocated map[string]bool
+	info      *Db_Ipam_Pool
+}
+
+type ipamDriver struct {
+	// below map maps a pool id to its pool object
+	pools map[string]*ipamPool
+	// lease renewals in progress, keyed by pool id and address
+	renewers map[string]chan struct{}
+	// VFs used by DHCP exchanges in progress, keyed by PF and VF index
+	leasing map[string]bool
+	driver  *driver
+	sync.Mutex
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uint32ToIP(value uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, value)
+	return ip
+}
+
+func ipamPoolID(netdev string, pool string) string {
+	if netdev == "" {
+		return pool
+	}
+	return netdev + "/" + pool
+}
+
+func parseIpRanges(ranges []string) ([]ipRange, error) {
+	var ipRanges []ipRange
+
+	for _, r := range ranges {
+		if r == "" {
+			continue
+		}
+		bounds := strings.SplitN(r, "-", 2)
+		start := net.ParseIP(bounds[0])
+		if start == nil || start.To4() == nil {
+			return nil, fmt.Errorf("Invalid reserved address %s", bounds[0])
+		}
+		end := start
+		if len(bounds) == 2 {
+			end = net.ParseIP(bounds[1])
+			if end == nil || end.To4() == nil {
+				return nil, fmt.Errorf("Invalid reserved address %s", bounds[1])
+			}
+		}
+		if ipToUint32(start) > ipToUint32(end) {
+			return nil, fmt.Errorf("Invalid reserved range %s", r)
+		}
+		ipRanges = append(ipRanges, ipRange{start: ipToUint32(start), end: ipToUint32(end)})
+	}
+	return ipRanges, nil
+}
+
+// parseIpamBindings parses address bindings of the form ip@vfN or ip@mac.
+func parseIpamBindings(value string) (map[string]*Db_Ipam_Binding, error) {
+	bindings := make(map[string]*Db_Ipam_Binding)
+
+	for _, entry := range strings.Split(value, ",") {
+		if entry == "" {
+			continue
+		}
+		fields := strings.SplitN(entry, "@", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Invalid binding %s, expected ip@vfN or ip@mac", entry)
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("Invalid binding address %s", fields[0])
+		}
+
+		binding := &Db_Ipam_Binding{VfIndex: -1, Static: true}
+		if strings.HasPrefix(fields[1], ipamBindVfPrefix) {
+			index, err := strconv.Atoi(strings.TrimPrefix(fields[1], ipamBindVfPrefix))
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("Invalid binding vf %s", fields[1])
+			}
+			binding.VfIndex = index
+		} else {
+			mac, err := net.ParseMAC(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid binding mac %s", fields[1])
+			}
+			binding.HwAddress = mac.String()
+		}
+		bindings[ip.String()] = binding
+	}
+	return bindings, nil
+}
+
+func newIpamPool(info *Db_Ipam_Pool) (*ipamPool, error) {
+	var err error
+
+	pool := &ipamPool{
+		id:        ipamPoolID(info.Netdev, info.Pool),
+		allocated: make(map[string]bool),
+		info:      info,
+	}
+
+	_, pool.subnet, err = net.ParseCIDR(info.Pool)
+	if err != nil || pool.subnet.IP.To4() == nil {
+		return nil, fmt.Errorf("Invalid pool %s", info.Pool)
+	}
+	if info.SubPool != "" {
+		_, pool.subPool, err = net.ParseCIDR(info.SubPool)
+		if err != nil || !pool.subnet.Contains(pool.subPool.IP) {
+			return nil, fmt.Errorf("Invalid sub pool %s", info.SubPool)
+		}
+	}
+	pool.reserved, err = parseIpRanges(info.Reserved)
+	if err != nil {
+		return nil, err
+	}
+	if info.Bindings == nil {
+		info.Bindings = make(map[string]*Db_Ipam_Binding)
+	}
+	if info.Leases == nil {
+		info.Leases = make(map[string]*Db_Ipam_Lease)
+	}
+	for _, address := range info.Allocated {
+		pool.allocated[address] = true
+	}
+	return pool, nil
+}
+
+func (pool *ipamPool) isReserved(ip net.IP) bool {
+	value := ipToUint32(ip)
+	for _, r := range pool.reserved {
+		if value >= r.start && value <= r.end {
+			return true
+		}
+	}
+	return false
+}
+
+func (pool *ipamPool) isStaticBound(ip net.IP) bool {
+	binding := pool.info.Bindings[ip.String()]
+	return binding != nil && binding.Static
+}
+
+// nextFreeAddress returns the first address of the pool which is neither
+// allocated, reserved nor statically bound to a VF.
+func (pool *ipamPool) nextFreeAddress() (net.IP, error) {
+	ipNet := pool.subnet
+	if pool.subPool != nil {
+		ipNet = pool.subPool
+	}
+
+	ones, bits := pool.subnet.Mask.Size()
+	first := ipToUint32(pool.subnet.IP)
+	last := first | (uint32(1)<<uint(bits-ones) - 1)
+
+	ones, bits = ipNet.Mask.Size()
+	start := ipToUint32(ipNet.IP)
+	end := start | (uint32(1)<<uint(bits-ones) - 1)
+
+	for value := start; value <= end && value >= start; value++ {
+		/* skip network and broadcast address */
+		if value == first || value == last {
+			continue
+		}
+		ip := uint32ToIP(value)
+		if pool.allocated[ip.String()] || pool.isReserved(ip) || pool.isStaticBound(ip) {
+			continue
+		}
+		return ip, nil
+	}
+	return nil, fmt.Errorf("No free address in pool %s", pool.id)
+}
+
+func (pool *ipamPool) persist() error {
+	pool.info.Allocated = pool.info.Allocated[:0]
+	for address := range pool.allocated {
+		pool.info.Allocated = append(pool.info.Allocated, address)
+	}
+	return Write_Ipam_Pool_to_DB(pool.id, pool.info)
+}
+
+func newIpamDriver() (*ipamDriver, error) {
+	i := &ipamDriver{
+		pools:    make(map[string]*ipamPool),
+		renewers: make(map[string]chan struct{}),
+		leasing:  make(map[string]bool),
+	}
+
+	poolList, err := Read_Ipam_Pools_From_DB()
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range poolList {
+		pool, err2 := newIpamPool(info)
+		if err2 != nil {
+			log.Printf("Skipping invalid ipam pool %s: %v\n", info.Pool, err2)
+			continue
+		}
+		i.pools[pool.id] = pool
+		for address := range pool.info.Leases {
+			i.startLeaseRenewal(pool, address)
+		}
+	}
+	return i, nil
+}
+
+func (i *ipamDriver) GetCapabilities() (*ipam.CapabilitiesResponse, error) {
+	return &ipam.CapabilitiesResponse{RequiresMACAddress: false}, nil
+}
+
+func (i *ipamDriver) GetDefaultAddressSpaces() (*ipam.AddressSpacesResponse, error) {
+	return &ipam.AddressSpacesResponse{
+		LocalDefaultAddressSpace:  ipamAddressSpace,
+		GlobalDefaultAddressSpace: ipamAddressSpace,
+	}, nil
+}
+
+func (i *ipamDriver) RequestPool(r *ipam.RequestPoolRequest) (*ipam.RequestPoolResponse, error) {
+	log.Printf("RequestPool() [ %+v ]\n", r)
+
+	i.Lock()
+	defer i.Unlock()
+
+	if r.V6 {
+		return nil, fmt.Errorf("IPv6 pools are not supported")
+	}
+	if r.Pool == "" {
+		return nil, fmt.Errorf("sriov ipam requires a subnet")
+	}
+	if r.Options[ipamMode] != "" && r.Options[ipamMode] != ipamModeDHCP {
+		return nil, fmt.Errorf("valid ipam modes are: dhcp")
+	}
+	if r.Options[ipamMode] == ipamModeDHCP && r.Options[networkDevice] == "" {
+		return nil, fmt.Errorf("dhcp ipam mode requires netdevice")
+	}
+
+	_, subnet, err := net.ParseCIDR(r.Pool)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid pool %s", r.Pool)
+	}
+
+	id := ipamPoolID(r.Options[networkDevice], subnet.String())
+	pool := i.pools[id]
+	if pool != nil && pool.info.Active {
+		return nil, fmt.Errorf("Pool %s is already in use", id)
+	}
+
+	bindings, err := parseIpamBindings(r.Options[ipamBind])
+	if err != nil {
+		return nil, err
+	}
+
+	info := &Db_Ipam_Pool{
+		Netdev:   r.Options[networkDevice],
+		Pool:     subnet.String(),
+		SubPool:  r.SubPool,
+		Mode:     r.Options[ipamMode],
+		Bindings: make(map[string]*Db_Ipam_Binding),
+		Active:   true,
+	}
+	if r.Options[ipamReserved] != "" {
+		info.Reserved = strings.Split(r.Options[ipamReserved], ",")
+	}
+	/* bindings learnt by a previous incarnation of the pool are sticky */
+	if pool != nil {
+		for address, binding := range pool.info.Bindings {
+			if !binding.Static {
+				info.Bindings[address] = binding
+			}
+		}
+	}
+	for address, binding := range bindings {
+		info.Bindings[address] = binding
+	}
+
+	pool, err = newIpamPool(info)
+	if err != nil {
+		return nil, err
+	}
+	err = pool.persist()
+	if err != nil {
+		return nil, err
+	}
+	i.pools[id] = pool
+
+	return &ipam.RequestPoolResponse{PoolID: id, Pool: pool.subnet.String()}, nil
+}
+
+func (i *ipamDriver) ReleasePool(r *ipam.ReleasePoolRequest) error {
+	log.Printf("ReleasePool() [ %+v ]\n", r)
+
+	i.Lock()
+	defer i.Unlock()
+
+	pool := i.pools[r.PoolID]
+	if pool == nil {
+		return fmt.Errorf("Can not find pool [ %s ].", r.PoolID)
+	}
+
+	/* keep the pool record so that bindings survive network recreation */
+	pool.info.Active = false
+	pool.allocated = make(map[string]bool)
+	return pool.persist()
+}
+
+func (i *ipamDriver) RequestAddress(r *ipam.RequestAddressRequest) (*ipam.RequestAddressResponse, error) {
+	var ip net.IP
+	var err error
+
+	log.Printf("RequestAddress() [ %+v ]\n", r)
+
+	i.Lock()
+	pool := i.pools[r.PoolID]
+	dhcp := pool != nil && pool.info.Mode == ipamModeDHCP &&
+		r.Options[ipamRequestAddressType] != ipamGatewayAddressType
+	i.Unlock()
+
+	if dhcp {
+		if r.Address != "" {
+			return nil, fmt.Errorf("Static addresses are not supported in dhcp mode")
+		}
+		return i.requestDhcpAddress(r)
+	}
+
+	i.Lock()
+	defer i.Unlock()
+
+	pool = i.pools[r.PoolID]
+	if pool == nil || !pool.info.Active {
+		return nil, fmt.Errorf("Can not find pool [ %s ].", r.PoolID)
+	}
+
+	if r.Address != "" {
+		ip = net.ParseIP(r.Address)
+		if ip == nil || !pool.subnet.Contains(ip) {
+			return nil, fmt.Errorf("Address %s does not belong to pool %s", r.Address, r.PoolID)
+		}
+		if pool.allocated[ip.String()] {
+			return nil, fmt.Errorf("Address %s is already in use", r.Address)
+		}
+	} else {
+		ip, err = pool.nextFreeAddress()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pool.allocated[ip.String()] = true
+	err = pool.persist()
+	if err != nil {
+		delete(pool.allocated, ip.String())
+		return nil, err
+	}
+
+	ones, _ := pool.subnet.Mask.Size()
+	address := fmt.Sprintf("%s/%d", ip.String(), ones)
+	log.Printf("RequestAddress pool [ %s ] type [ %s ] address: %s\n",
+		r.PoolID, r.Options[ipamRequestAddressType], address)
+	return &ipam.RequestAddressResponse{Address: address}, nil
+}
+
+func (i *ipamDriver) ReleaseAddress(r *ipam.ReleaseAddressRequest) error {
+	log.Printf("ReleaseAddress() [ %+v ]\n", r)
+
+	i.Lock()
+	defer i.Unlock()
+
+	pool := i.pools[r.PoolID]
+	if pool == nil {
+		return fmt.Errorf("Can not find pool [ %s ].", r.PoolID)
+	}
+
+	ip := net.ParseIP(r.Address)
+	if ip == nil {
+		return fmt.Errorf("Invalid address %s", r.Address)
+	}
+	i.releaseLease(pool, ip.String())
+	delete(pool.allocated, ip.String())
+	return pool.persist()
+}
+
+// findPool returns the active pool backing the subnet of a network on
+// the given PF netdevice.
+func (i *ipamDriver) findPool(netdev string, subnet string) *ipamPool {
+	for _, pool := range i.pools {
+		if !pool.info.Active || pool.info.Pool != subnet {
+			continue
+		}
+		if pool.info.Netdev == "" || pool.info.Netdev == netdev {
+			return pool
+		}
+	}
+	return nil
+}
+
+// lookupBinding returns the VF binding of an endpoint address, if any.
+func (i *ipamDriver) lookupBinding(netdev string, subnet string, address string) *Db_Ipam_Binding {
+	if i == nil || address == "" {
+		return nil
+	}
+
+	i.Lock()
+	defer i.Unlock()
+
+	pool := i.findPool(netdev, subnet)
+	if pool == nil {
+		return nil
+	}
+	ip, _, err := net.ParseCIDR(address)
+	if err != nil {
+		return nil
+	}
+	return pool.info.Bindings[ip.String()]
+}
+
+// learnBinding records which VF an endpoint address ended up on so that
+// the same VF is picked again for this address.
+func (i *ipamDriver) learnBinding(netdev string, subnet string, address string,
+	vfIndex int, hwAddress string) {
+	if i == nil || address == "" {
+		return
+	}
+
+	i.Lock()
+	defer i.Unlock()
+
+	pool := i.findPool(netdev, subnet)
+	if pool == nil {
+		return
+	}
+	ip, _, err := net.ParseCIDR(address)
+	if err != nil {
+		return
+	}
+	binding := pool.info.Bindings[ip.String()]
+	if binding != nil && binding.Static {
+		return
+	}
+	pool.info.Bindings[ip.String()] = &Db_Ipam_Binding{
+		VfIndex:   vfIndex,
+		HwAddress: hwAddress,
+	}
+	pool.persist()
+}
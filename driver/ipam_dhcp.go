@@ -0,0 +1,492 @@
+package driver
+
+import (
+	"fmt"
+	"github.com/Mellanox/sriovnet"
+	"github.com/docker/go-plugins-helpers/ipam"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"log"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ipamMode     = "mode" // --ipam-opt mode=dhcp
+	ipamModeDHCP = "dhcp"
+
+	dhcpRenewRetryInterval = 30 * time.Second
+)
+
+// dhcpVfPicker is implemented by networks which can tell the VF their next
+// endpoint gets without allocating it, so that the address is leased on
+// that VF.
+type dhcpVfPicker interface {
+	peekVf(excluded map[int]bool) (int, string, error)
+}
+
+// peekVf returns the index and netdevice of the VF the VF policy of the
+// network picks among its free VFs, skipping the excluded ones.
+func (nw *sriovNetwork) peekVf(excluded map[int]bool) (int, string, error) {
+	var free []int
+
+	dev := pfDevices[nw.genNw.ndevName]
+	if dev == nil || dev.pfHandle == nil {
+		return -1, "", fmt.Errorf("Invalid SRIOV configuration")
+	}
+	poolVfs, err := nw.freePoolVfs(dev)
+	if err != nil {
+		return -1, "", err
+	}
+	for _, index := range poolVfs {
+		if !excluded[index] {
+			free = append(free, index)
+		}
+	}
+	if len(free) == 0 {
+		return -1, "", fmt.Errorf("All Vfs for %v are allocated", nw.genNw.ndevName)
+	}
+	index := free[nw.allocator.pick(nw.genNw.ndevName, free)]
+	for _, vf := range dev.pfHandle.List {
+		if vf.Index == index {
+			return index, sriovnet.GetVfNetdevName(dev.pfHandle, vf), nil
+		}
+	}
+	return -1, "", fmt.Errorf("vf %d not found on %v", index, nw.genNw.ndevName)
+}
+
+// peekVf returns the index and netdevice of the VF the VF policy of the
+// network picks among its free VFs, skipping the excluded ones.
+func (nw *dpSriovNetwork) peekVf(excluded map[int]bool) (int, string, error) {
+	dev := dpPfDevices[nw.genNw.ndevName]
+	if dev == nil {
+		return -1, "", fmt.Errorf("Invalid SRIOV configuration")
+	}
+	pos := nw.pickVF(dev, excluded)
+	if pos < 0 {
+		return -1, "", fmt.Errorf("All Vfs for %v are allocated", nw.genNw.ndevName)
+	}
+	vfName := dev.childNetdevLlist[pos]
+	index, err := vfIndexOfNetdev(nw.genNw.ndevName, vfName)
+	if err != nil {
+		return -1, "", err
+	}
+	return index, vfName, nil
+}
+
+// dhcpNetwork returns the network whose endpoints get addresses of the
+// pool.
+func (d *driver) dhcpNetwork(pool *ipamPool) (dhcpVfPicker, error) {
+	for _, nw := range d.networks {
+		genNw := nw.getGenNw()
+		if genNw.ndevName != pool.info.Netdev || genNw.IPv4Data == nil ||
+			genNw.IPv4Data.Pool != pool.info.Pool {
+			continue
+		}
+		picker, ok := nw.(dhcpVfPicker)
+		if !ok {
+			return nil, fmt.Errorf("dhcp is not supported in %s mode", genNw.mode)
+		}
+		return picker, nil
+	}
+	return nil, fmt.Errorf("No sriov network found on %s for pool %s", pool.info.Netdev, pool.info.Pool)
+}
+
+// dhcpConnForLease opens a DHCP socket on the VF holding the lease, either
+// in the host or, once joined, in the container network namespace.
+func dhcpConnForLease(lease *Db_Ipam_Lease) (*dhcpDeviceConn, error) {
+	if lease.SandboxKey == "" {
+		link, err := findLinkByHwAddr(lease.HwAddress)
+		if err != nil {
+			return nil, err
+		}
+		return newDhcpDeviceConn(link.Attrs().Name)
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origNs, err := netns.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer origNs.Close()
+
+	sandboxNs, err := netns.GetFromPath(lease.SandboxKey)
+	if err != nil {
+		return nil, err
+	}
+	defer sandboxNs.Close()
+
+	err = netns.Set(sandboxNs)
+	if err != nil {
+		return nil, err
+	}
+	defer netns.Set(origNs)
+
+	link, err := findLinkByHwAddr(lease.HwAddress)
+	if err != nil {
+		return nil, err
+	}
+	return newDhcpDeviceConn(link.Attrs().Name)
+}
+
+func dbLeaseToLease(address string, lease *Db_Ipam_Lease) *dhcpLease {
+	return &dhcpLease{
+		Address:   net.ParseIP(address),
+		ServerID:  net.ParseIP(lease.ServerID),
+		Router:    net.ParseIP(lease.Router),
+		LeaseTime: time.Duration(lease.LeaseTime) * time.Second,
+		T1:        time.Duration(lease.T1) * time.Second,
+	}
+}
+
+func updateDbLease(dbLease *Db_Ipam_Lease, lease *dhcpLease) {
+	dbLease.ServerID = lease.ServerID.String()
+	if lease.Router != nil {
+		dbLease.Router = lease.Router.String()
+	}
+	dbLease.LeaseTime = int64(lease.LeaseTime / time.Second)
+	dbLease.T1 = int64(lease.T1 / time.Second)
+	dbLease.RenewedAt = time.Now().Unix()
+}
+
+func leasingKey(pfNetdevName string, vfIndex int) string {
+	return pfNetdevName + "/" + strconv.Itoa(vfIndex)
+}
+
+// leasedVFs returns the VFs of the PF which hold a lease or are used by a
+// DHCP exchange in progress.
+func (i *ipamDriver) leasedVFs(pfNetdevName string) map[int]bool {
+	reserved := make(map[int]bool)
+
+	for _, pool := range i.pools {
+		if pool.info.Netdev != pfNetdevName {
+			continue
+		}
+		for address := range pool.info.Leases {
+			binding := pool.info.Bindings[address]
+			if binding != nil {
+				reserved[binding.VfIndex] = true
+			}
+		}
+	}
+	for key := range i.leasing {
+		if strings.HasPrefix(key, pfNetdevName+"/") {
+			index, err := strconv.Atoi(strings.TrimPrefix(key, pfNetdevName+"/"))
+			if err == nil {
+				reserved[index] = true
+			}
+		}
+	}
+	return reserved
+}
+
+// vfIsFree tells whether the VF of the PF is still free for an endpoint.
+func (d *driver) vfIsFree(pfNetdevName string, vfIndex int) bool {
+	dev := pfDevices[pfNetdevName]
+	if dev != nil && dev.pfHandle != nil {
+		for _, vf := range dev.pfHandle.List {
+			if vf.Index == vfIndex {
+				return !vf.Allocated
+			}
+		}
+		return false
+	}
+	dpDev := dpPfDevices[pfNetdevName]
+	if dpDev != nil {
+		for _, vfName := range dpDev.childNetdevLlist {
+			index, err := vfIndexOfNetdev(pfNetdevName, vfName)
+			if err == nil && index == vfIndex {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pickDhcpVF picks the VF which leases the address through the network of
+// the pool, so that the VF range, reservations, deny list and VF policy of
+// the network apply, and marks it as used by a DHCP exchange.
+func (i *ipamDriver) pickDhcpVF(r *ipam.RequestAddressRequest) (*ipamPool, int, string, error) {
+	i.driver.Lock()
+	defer i.driver.Unlock()
+
+	i.Lock()
+	defer i.Unlock()
+
+	pool := i.pools[r.PoolID]
+	if pool == nil || !pool.info.Active {
+		return nil, -1, "", fmt.Errorf("Can not find pool [ %s ].", r.PoolID)
+	}
+	nw, err := i.driver.dhcpNetwork(pool)
+	if err != nil {
+		return nil, -1, "", err
+	}
+	vfIndex, vfNetdev, err := nw.peekVf(i.leasedVFs(pool.info.Netdev))
+	if err != nil {
+		return nil, -1, "", err
+	}
+	i.leasing[leasingKey(pool.info.Netdev, vfIndex)] = true
+	return pool, vfIndex, vfNetdev, nil
+}
+
+// acquireDhcpLease leases an address on the VF from the DHCP server. It
+// waits on the network, so it runs without plugin locks.
+func acquireDhcpLease(vfNetdev string) (*dhcpClient, *dhcpLease, error) {
+	vfLink, err := netlink.LinkByName(vfNetdev)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = netlink.LinkSetUp(vfLink)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Fail to set vf %s link up: %v", vfNetdev, err)
+	}
+
+	conn, err := newDhcpDeviceConn(vfNetdev)
+	if err != nil {
+		return nil, nil, err
+	}
+	client := newDhcpClient(conn, vfLink.Attrs().HardwareAddr)
+	lease, err := client.Acquire()
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("Fail to lease address on %s: %v", vfNetdev, err)
+	}
+	return client, lease, nil
+}
+
+// requestDhcpAddress leases an address from the DHCP server of the physical
+// network using the VF which CreateEndpoint will hand over for it. The VF
+// is picked and the lease is committed under the plugin locks, the DHCP
+// exchange in between runs without them.
+func (i *ipamDriver) requestDhcpAddress(r *ipam.RequestAddressRequest) (*ipam.RequestAddressResponse, error) {
+	pool, vfIndex, vfNetdev, err := i.pickDhcpVF(r)
+	if err != nil {
+		return nil, err
+	}
+	pfNetdevName := pool.info.Netdev
+
+	client, lease, err := acquireDhcpLease(vfNetdev)
+	if err == nil {
+		defer client.conn.Close()
+	}
+
+	i.driver.Lock()
+	defer i.driver.Unlock()
+
+	i.Lock()
+	defer i.Unlock()
+
+	delete(i.leasing, leasingKey(pfNetdevName, vfIndex))
+	if err != nil {
+		return nil, err
+	}
+	if i.pools[r.PoolID] != pool || !pool.info.Active {
+		client.Release(lease)
+		return nil, fmt.Errorf("Pool [ %s ] was released while leasing an address", r.PoolID)
+	}
+	if !i.driver.vfIsFree(pfNetdevName, vfIndex) {
+		client.Release(lease)
+		return nil, fmt.Errorf("vf %s was allocated while leasing an address", vfNetdev)
+	}
+	if !pool.subnet.Contains(lease.Address) {
+		client.Release(lease)
+		return nil, fmt.Errorf("Leased address %v is outside of pool %s", lease.Address, r.PoolID)
+	}
+
+	address := lease.Address.String()
+	dbLease := &Db_Ipam_Lease{HwAddress: client.hwAddr.String()}
+	updateDbLease(dbLease, lease)
+
+	pool.allocated[address] = true
+	pool.info.Leases[address] = dbLease
+	pool.info.Bindings[address] = &Db_Ipam_Binding{
+		VfIndex:   vfIndex,
+		HwAddress: dbLease.HwAddress,
+		Static:    true,
+	}
+	err = pool.persist()
+	if err != nil {
+		return nil, err
+	}
+	i.startLeaseRenewal(pool, address)
+
+	ones, _ := pool.subnet.Mask.Size()
+	log.Printf("RequestAddress leased %s/%d on vf %s\n", address, ones, vfNetdev)
+	return &ipam.RequestAddressResponse{Address: fmt.Sprintf("%s/%d", address, ones)}, nil
+}
+
+func (i *ipamDriver) startLeaseRenewal(pool *ipamPool, address string) {
+	key := pool.id + "/" + address
+	if i.renewers[key] != nil {
+		return
+	}
+	stop := make(chan struct{})
+	i.renewers[key] = stop
+	go i.renewLease(pool, address, stop)
+}
+
+func (i *ipamDriver) stopLeaseRenewal(pool *ipamPool, address string) {
+	key := pool.id + "/" + address
+	stop := i.renewers[key]
+	if stop != nil {
+		close(stop)
+		delete(i.renewers, key)
+	}
+}
+
+// renewLease keeps the lease of an address alive until the renewal is
+// stopped on release of the address.
+func (i *ipamDriver) renewLease(pool *ipamPool, address string, stop chan struct{}) {
+	var wait time.Duration
+
+	for {
+		i.Lock()
+		dbLease := pool.info.Leases[address]
+		if dbLease == nil {
+			i.Unlock()
+			return
+		}
+		if dbLease.T1 <= 0 {
+			/* infinite lease */
+			i.Unlock()
+			log.Printf("Lease of %s has no lease time, it is not renewed\n", address)
+			return
+		}
+		renewAt := time.Unix(dbLease.RenewedAt, 0).Add(time.Duration(dbLease.T1) * time.Second)
+		wait = renewAt.Sub(time.Now())
+		if wait < 0 {
+			wait = 0
+		}
+		i.Unlock()
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+
+		i.Lock()
+		dbLease = pool.info.Leases[address]
+		if dbLease == nil {
+			i.Unlock()
+			return
+		}
+		leaseCopy := *dbLease
+		i.Unlock()
+
+		lease, err := renewDhcpLease(address, &leaseCopy)
+		if err != nil {
+			log.Printf("Fail to renew lease of %s: %v\n", address, err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(dhcpRenewRetryInterval):
+			}
+			continue
+		}
+
+		i.Lock()
+		dbLease = pool.info.Leases[address]
+		if dbLease != nil {
+			updateDbLease(dbLease, lease)
+			pool.persist()
+		}
+		i.Unlock()
+	}
+}
+
+func renewDhcpLease(address string, dbLease *Db_Ipam_Lease) (*dhcpLease, error) {
+	conn, err := dhcpConnForLease(dbLease)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	hwAddr, err := net.ParseMAC(dbLease.HwAddress)
+	if err != nil {
+		return nil, err
+	}
+	client := newDhcpClient(conn, hwAddr)
+	return client.Renew(dbLeaseToLease(address, dbLease))
+}
+
+// releaseLease stops renewing the lease of an address and releases it
+// to the DHCP server.
+func (i *ipamDriver) releaseLease(pool *ipamPool, address string) {
+	dbLease := pool.info.Leases[address]
+	if dbLease == nil {
+		return
+	}
+	i.stopLeaseRenewal(pool, address)
+
+	conn, err := dhcpConnForLease(dbLease)
+	if err == nil {
+		hwAddr, _ := net.ParseMAC(dbLease.HwAddress)
+		client := newDhcpClient(conn, hwAddr)
+		err = client.Release(dbLeaseToLease(address, dbLease))
+		conn.Close()
+	}
+	if err != nil {
+		log.Printf("Fail to release lease of %s: %v\n", address, err)
+	}
+
+	delete(pool.info.Leases, address)
+	delete(pool.info.Bindings, address)
+	pool.persist()
+}
+
+func (i *ipamDriver) findLease(netdev string, subnet string, address string) (*ipamPool, string) {
+	pool := i.findPool(netdev, subnet)
+	if pool == nil {
+		return nil, ""
+	}
+	ip, _, err := net.ParseCIDR(address)
+	if err != nil || pool.info.Leases[ip.String()] == nil {
+		return nil, ""
+	}
+	return pool, ip.String()
+}
+
+// leaseJoined moves renewals of the endpoint address into the sandbox and
+// returns the router handed out by the DHCP server.
+func (i *ipamDriver) leaseJoined(netdev string, subnet string, address string, sandboxKey string) string {
+	if i == nil {
+		return ""
+	}
+
+	i.Lock()
+	defer i.Unlock()
+
+	pool, ip := i.findLease(netdev, subnet, address)
+	if pool == nil {
+		return ""
+	}
+	dbLease := pool.info.Leases[ip]
+	dbLease.SandboxKey = sandboxKey
+	pool.persist()
+	return dbLease.Router
+}
+
+func (i *ipamDriver) leaseLeft(netdev string, subnet string, address string) {
+	i.leaseJoined(netdev, subnet, address, "")
+}
+
+// releaseEndpointLease releases the DHCP lease of a deleted endpoint.
+func (i *ipamDriver) releaseEndpointLease(netdev string, subnet string, address string) {
+	if i == nil {
+		return
+	}
+
+	i.Lock()
+	defer i.Unlock()
+
+	pool, ip := i.findLease(netdev, subnet, address)
+	if pool != nil {
+		i.releaseLease(pool, ip)
+	}
+}
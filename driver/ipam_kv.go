@@ -0,0 +1,105 @@
+package driver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	persistIpamPath = "/etc/docker/mellanox/docker-sriov-plugin-ipam"
+)
+
+/* IPAM configuration layout
+ipam/
+	<netdev>_<pool>.json
+	<pool>.json
+*/
+
+/* Address binding of a pool */
+type Db_Ipam_Binding struct {
+	VfIndex   int    `json:"VfIndex"`
+	HwAddress string `json:"Hw_Address"`
+	Static    bool   `json:"Static"`
+}
+
+/* DHCP lease of an address of a pool */
+type Db_Ipam_Lease struct {
+	HwAddress  string `json:"Hw_Address"`
+	ServerID   string `json:"ServerID"`
+	Router     string `json:"Router"`
+	LeaseTime  int64  `json:"LeaseTime"`
+	T1         int64  `json:"T1"`
+	RenewedAt  int64  `json:"RenewedAt"`
+	SandboxKey string `json:"SandboxKey"`
+}
+
+/* Pool <netdev>_<pool>.json */
+type Db_Ipam_Pool struct {
+	Version   uint32                      `json:"Version"`
+	Netdev    string                      `json:"Netdevice"`
+	Pool      string                      `json:"Pool"`
+	SubPool   string                      `json:"SubPool"`
+	Mode      string                      `json:"Mode"`
+	Reserved  []string                    `json:"Reserved"`
+	Allocated []string                    `json:"Allocated"`
+	Bindings  map[string]*Db_Ipam_Binding `json:"Bindings"`
+	Leases    map[string]*Db_Ipam_Lease   `json:"Leases"`
+	Active    bool                        `json:"Active"`
+}
+
+func ipamPoolFile(poolID string) string {
+	fileName := strings.Replace(poolID, "/", "_", -1) + ".json"
+	return filepath.Join(persistIpamPath, fileName)
+}
+
+func Write_Ipam_Pool_to_DB(poolID string, pool *Db_Ipam_Pool) error {
+	rawData, err := json.Marshal(pool)
+	if err != nil {
+		return err
+	}
+
+	err = createDir(persistIpamPath)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(ipamPoolFile(poolID), rawData, os.FileMode(0644))
+	return err
+}
+
+func Del_Ipam_Pool_From_DB(poolID string) error {
+
+	os.Remove(ipamPoolFile(poolID))
+	return nil
+}
+
+func Read_Ipam_Pools_From_DB() ([]*Db_Ipam_Pool, error) {
+	var poolList []*Db_Ipam_Pool
+
+	_, err := os.Lstat(persistIpamPath)
+	if err != nil {
+		return nil, nil
+	}
+
+	files, err2 := lsFilesWithPrefix(persistIpamPath, ".json", true)
+	if err2 != nil {
+		return nil, err2
+	}
+
+	for _, file := range files {
+		rawData, err3 := ioutil.ReadFile(filepath.Join(persistIpamPath, file))
+		if err3 != nil {
+			return nil, err3
+		}
+		pool := Db_Ipam_Pool{}
+		err = json.Unmarshal(rawData, &pool)
+		if err != nil {
+			return nil, err
+		}
+		poolList = append(poolList, &pool)
+	}
+	return poolList, nil
+}
@@ -0,0 +1,151 @@
+package driver
+
+import (
+	"fmt"
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/vishvananda/netlink"
+	"log"
+)
+
+const (
+	ipoibDefaultPkey  = 0xffff
+	ipoibModeDatagram = "datagram"
+	ipoibModeConnect  = "connected"
+	ipoibChildPrefix  = "ib"
+	ipoibChildIDLen   = 12
+)
+
+var ipoibModes = map[string]netlink.IPoIBMode{
+	ipoibModeDatagram: netlink.IPOIB_MODE_DATAGRAM,
+	ipoibModeConnect:  netlink.IPOIB_MODE_CONNECTED,
+}
+
+// ipoibChildNetwork gives each container an IPoIB child interface of the
+// parent on the partition of the network, for hosts without SR-IOV.
+type ipoibChildNetwork struct {
+	genNw *genericNetwork
+	pkey  uint16
+	mode  netlink.IPoIBMode
+}
+
+func ipoibChildName(endpointID string) string {
+	if len(endpointID) > ipoibChildIDLen {
+		endpointID = endpointID[:ipoibChildIDLen]
+	}
+	return ipoibChildPrefix + endpointID
+}
+
+func (nw *ipoibChildNetwork) getGenNw() *genericNetwork {
+	return nw.genNw
+}
+
+func (nw *ipoibChildNetwork) CreateNetwork(d *driver, genNw *genericNetwork,
+	nid string, options map[string]string,
+	ipv4Data *network.IPAMData) error {
+	var err error
+
+	ndevName := options[networkDevice]
+	if !isIBNetdev(ndevName) {
+		return fmt.Errorf("ipoib-child mode requires an InfiniBand device")
+	}
+
+	nw.pkey = ipoibDefaultPkey
+	if options[networkPkey] != "" {
+		nw.pkey, err = parsePkey(options[networkPkey])
+		if err != nil {
+			return err
+		}
+	}
+
+	mode := options[networkIPoIBMode]
+	if mode == "" {
+		mode = ipoibModeDatagram
+	}
+	ipoibMode, ok := ipoibModes[mode]
+	if !ok {
+		return fmt.Errorf("valid ipoib modes are: %s and %s", ipoibModeDatagram, ipoibModeConnect)
+	}
+	nw.mode = ipoibMode
+
+	nw.genNw = genNw
+
+	err = SetPFLinkUp(ndevName)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("IPoIB child CreateNetwork : [%s] pkey: 0x%04x IPv4Data : [ %+v ]\n",
+		nw.genNw.id, nw.pkey, nw.genNw.IPv4Data)
+	return nil
+}
+
+func (nw *ipoibChildNetwork) DeleteNetwork(d *driver, req *network.DeleteNetworkRequest) {
+
+}
+
+func (nw *ipoibChildNetwork) CreateEndpoint(r *network.CreateEndpointRequest) (*network.CreateEndpointResponse, error) {
+
+	parent, err := netlink.LinkByName(nw.genNw.ndevName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each child gets its own QP from the kernel, so several children can
+	// share the partition.
+	child := &netlink.IPoIB{
+		LinkAttrs: netlink.NewLinkAttrs(),
+		Pkey:      nw.pkey,
+		Mode:      nw.mode,
+	}
+	child.Name = ipoibChildName(r.EndpointID)
+	child.ParentIndex = parent.Attrs().Index
+
+	err = netlink.LinkAdd(child)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to create ipoib child %s: %v", child.Name, err)
+	}
+
+	ndev := &ptEndpoint{
+		devName: child.Name,
+		Address: r.Interface.Address,
+	}
+
+	ndev.rdmaState, err = nw.genNw.rdmaTuning.apply(ndev.devName)
+	if err != nil {
+		nw.DeleteEndpoint(ndev)
+		return nil, fmt.Errorf("Fail to apply rdma settings: %v", err)
+	}
+	nw.genNw.ndevEndpoints[r.EndpointID] = ndev
+
+	resp := &network.CreateEndpointResponse{Interface: &network.EndpointInterface{}}
+	log.Printf("IPoIB child CreateEndpoint %s parent: %s\n", child.Name, nw.genNw.ndevName)
+	return resp, nil
+}
+
+func (nw *ipoibChildNetwork) DeleteEndpoint(endpoint *ptEndpoint) {
+
+	endpoint.rdmaState.revert()
+	link, err := netlink.LinkByName(endpoint.devName)
+	if err == nil {
+		err = netlink.LinkDel(link)
+	}
+	if err != nil {
+		log.Printf("Fail to delete ipoib child %s: %v\n", endpoint.devName, err)
+	}
+}
+
+// RestoreEndpoint takes over an IPoIB child created before the plugin
+// restarted.
+func (nw *ipoibChildNetwork) RestoreEndpoint(id string, dbEp *DB_Endpoint) error {
+
+	_, err := netlink.LinkByName(dbEp.DevName)
+	if err != nil {
+		return err
+	}
+	nw.genNw.ndevEndpoints[id] = &ptEndpoint{
+		devName:   dbEp.DevName,
+		Address:   dbEp.Address,
+		rdmaState: rdmaStateFromDb(dbEp.RdmaState),
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package driver
+
+import (
+	"fmt"
+	"github.com/docker/go-plugins-helpers/network"
+	"log"
+	"sort"
+	"strings"
+)
+
+const (
+	pfPolicyMostFree  = "most-free"
+	pfPolicyLeastLoad = "least-load"
+)
+
+// multiPfNetwork allocates the VFs of its endpoints from several PFs. The
+// VFs of a PF are managed by an sriovNetwork of that PF.
+type multiPfNetwork struct {
+	genNw  *genericNetwork
+	pfs    []*sriovNetwork
+	policy string
+}
+
+func (nw *multiPfNetwork) getGenNw() *genericNetwork {
+	return nw.genNw
+}
+
+// resolvePfPool returns the PFs of a network, given either as a list of
+// netdevices or as a selector.
+func resolvePfPool(options map[string]string) ([]string, error) {
+	if options[networkDevice] != "" {
+		return strings.Split(options[networkDevice], ","), nil
+	}
+
+	sel, err := parsePfSelector(options[networkPfPool])
+	if err != nil {
+		return nil, err
+	}
+	pfs, err := selectPfs(sel, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(pfs) == 0 {
+		return nil, fmt.Errorf("no SRIOV PF matches pf_pool %s", options[networkPfPool])
+	}
+	return pfs, nil
+}
+
+func (nw *multiPfNetwork) CreateNetwork(d *driver, genNw *genericNetwork,
+	nid string, options map[string]string,
+	ipv4Data *network.IPAMData) error {
+	var err error
+
+	nw.policy = options[networkPfPolicy]
+	if nw.policy == "" {
+		nw.policy = pfPolicyMostFree
+	}
+	if nw.policy != pfPolicyMostFree && nw.policy != pfPolicyLeastLoad {
+		return fmt.Errorf("valid pf_policy values are: %s and %s", pfPolicyMostFree, pfPolicyLeastLoad)
+	}
+
+	pfNetdevNames, err := resolvePfPool(options)
+	if err != nil {
+		return err
+	}
+	// resolved PFs are stored with the network, so that the network keeps
+	// its PFs across plugin restarts.
+	options[networkDevice] = strings.Join(pfNetdevNames, ",")
+	genNw.ndevName = options[networkDevice]
+	nw.genNw = genNw
+
+	for _, pfNetdevName := range pfNetdevNames {
+		if checkMultiPortDevice(pfNetdevName) {
+			err = fmt.Errorf("multiport device %s can't be in a PF pool", pfNetdevName)
+			break
+		}
+
+		pfOptions := make(map[string]string)
+		for k, v := range options {
+			pfOptions[k] = v
+		}
+		pfOptions[networkDevice] = pfNetdevName
+
+		pfNwID := pfNetworkID(nid, pfNetdevName)
+		pfGenNw := createGenNw(pfNwID, pfNetdevName, genNw.mode, genNw.ethPrefix, ipv4Data)
+		pfGenNw.driver = d
+		pfGenNw.rdmaTuning = genNw.rdmaTuning
+		pfGenNw.numaPolicy = genNw.numaPolicy
+
+		pfNw := &sriovNetwork{}
+		err = pfNw.CreateNetwork(d, pfGenNw, pfNwID, pfOptions, ipv4Data)
+		if err != nil {
+			err = fmt.Errorf("%s: %v", pfNetdevName, err)
+			break
+		}
+		nw.pfs = append(nw.pfs, pfNw)
+	}
+	if err != nil {
+		nw.DeleteNetwork(d, &network.DeleteNetworkRequest{NetworkID: nid})
+		return err
+	}
+
+	log.Printf("Multi PF CreateNetwork : [%s] PFs: %v IPv4Data : [ %+v ]\n",
+		nw.genNw.id, pfNetdevNames, nw.genNw.IPv4Data)
+	return nil
+}
+
+func (nw *multiPfNetwork) DeleteNetwork(d *driver, req *network.DeleteNetworkRequest) {
+	for _, pfNw := range nw.pfs {
+		pfNw.DeleteNetwork(d, &network.DeleteNetworkRequest{NetworkID: pfNw.genNw.id})
+	}
+	nw.pfs = nil
+}
+
+// vfPoolUsage returns the number of free and allocated VFs of the VF pool
+// of a per-PF network.
+func (nw *sriovNetwork) vfPoolUsage() (int, int) {
+	var free, used int
+
+	dev := pfDevices[nw.genNw.ndevName]
+	if dev == nil || dev.pfHandle == nil {
+		return 0, 0
+	}
+	for _, vf := range dev.pfHandle.List {
+		if dev.denied[vf.Index] || !nw.inVfPool(vf.Index) {
+			continue
+		}
+		if vf.Allocated {
+			used++
+		} else {
+			free++
+		}
+	}
+	return free, used
+}
+
+// pfOnNumaNodes tells whether a PF is on one of the NUMA nodes.
+func pfOnNumaNodes(pfNetdevName string, nodes []int) bool {
+	pciAddr, err := netdevPciAddress(pfNetdevName)
+	return err == nil && containsInt(nodes, pciDevNumaNode(pciAddr))
+}
+
+// orderPfs returns the PFs in the order of preference of the policy, the
+// ones on the NUMA nodes of the container of the new endpoint first.
+func (nw *multiPfNetwork) orderPfs() []*sriovNetwork {
+	pfs := make([]*sriovNetwork, len(nw.pfs))
+	copy(pfs, nw.pfs)
+
+	nodes := nw.genNw.numaNodes
+	sort.SliceStable(pfs, func(i, j int) bool {
+		if len(nodes) != 0 {
+			localI := pfOnNumaNodes(pfs[i].genNw.ndevName, nodes)
+			localJ := pfOnNumaNodes(pfs[j].genNw.ndevName, nodes)
+			if localI != localJ {
+				return localI
+			}
+		}
+		freeI, usedI := pfs[i].vfPoolUsage()
+		freeJ, usedJ := pfs[j].vfPoolUsage()
+		if nw.policy == pfPolicyLeastLoad {
+			return usedI < usedJ
+		}
+		return freeI > freeJ
+	})
+	return pfs
+}
+
+func (nw *multiPfNetwork) findPf(pfNetdevName string) *sriovNetwork {
+	for _, pfNw := range nw.pfs {
+		if pfNw.genNw.ndevName == pfNetdevName {
+			return pfNw
+		}
+	}
+	return nil
+}
+
+func (nw *multiPfNetwork) CreateEndpoint(r *network.CreateEndpointRequest) (*network.CreateEndpointResponse, error) {
+	var errs []string
+
+	// A PF may be out of VFs, or not have the VF of a requested MAC
+	// address, so the next PF is tried.
+	for _, pfNw := range nw.orderPfs() {
+		pfNw.genNw.numaNodes = nw.genNw.numaNodes
+		resp, err := pfNw.CreateEndpoint(r)
+		pfNw.genNw.numaNodes = nil
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", pfNw.genNw.ndevName, err))
+			continue
+		}
+		ndev := pfNw.genNw.ndevEndpoints[r.EndpointID]
+		ndev.pf = pfNw.genNw.ndevName
+		nw.genNw.ndevEndpoints[r.EndpointID] = ndev
+		log.Printf("Multi PF CreateEndpoint [ %s ] PF: %s\n", r.EndpointID, ndev.pf)
+		return resp, nil
+	}
+	return nil, fmt.Errorf("Fail to allocate VF from PFs: %s", strings.Join(errs, "; "))
+}
+
+func (nw *multiPfNetwork) DeleteEndpoint(endpoint *ptEndpoint) {
+	pfNw := nw.findPf(endpoint.pf)
+	if pfNw == nil {
+		log.Printf("PF %s of endpoint %s is not in the network\n", endpoint.pf, endpoint.id)
+		return
+	}
+	pfNw.DeleteEndpoint(endpoint)
+	delete(pfNw.genNw.ndevEndpoints, endpoint.id)
+}
+
+// RestoreEndpoint hands an endpoint created before the plugin restarted to
+// the network of its PF.
+func (nw *multiPfNetwork) RestoreEndpoint(id string, dbEp *DB_Endpoint) error {
+	pfNw := nw.findPf(dbEp.Pf)
+	if pfNw == nil {
+		return fmt.Errorf("PF %s of endpoint is not in the network", dbEp.Pf)
+	}
+	err := pfNw.RestoreEndpoint(id, dbEp)
+	if err != nil {
+		return err
+	}
+	ndev := pfNw.genNw.ndevEndpoints[id]
+	ndev.pf = dbEp.Pf
+	nw.genNw.ndevEndpoints[id] = ndev
+	return nil
+}
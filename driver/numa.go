@@ -0,0 +1,201 @@
+package driver
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	numaPolicyStrict    = "strict"
+	numaPolicyPreferred = "preferred"
+	numaPolicyIgnore    = "ignore"
+
+	numaNodesDir   = "/sys/devices/system/node"
+	numaNodePrefix = "node"
+	numaCpuList    = "cpulist"
+)
+
+func parseNumaPolicy(value string) (string, error) {
+	switch value {
+	case "", numaPolicyIgnore:
+		return numaPolicyIgnore, nil
+	case numaPolicyStrict, numaPolicyPreferred:
+		return value, nil
+	}
+	return "", fmt.Errorf("valid numa policies are: %s, %s and %s",
+		numaPolicyStrict, numaPolicyPreferred, numaPolicyIgnore)
+}
+
+// parseIndexList parses a list of cpus, NUMA nodes or VFs such as
+// 0-3,8,10-11.
+func parseIndexList(value string) ([]int, error) {
+	var ids []int
+
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+	for _, item := range strings.Split(value, ",") {
+		bounds := strings.SplitN(item, "-", 2)
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid list %s", value)
+		}
+		end := start
+		if len(bounds) == 2 {
+			end, err = strconv.Atoi(bounds[1])
+			if err != nil || end < start {
+				return nil, fmt.Errorf("Invalid list %s", value)
+			}
+		}
+		for id := start; id <= end; id++ {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func containsInt(list []int, value int) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// cpusNumaNodes returns the NUMA nodes of the cpus.
+func cpusNumaNodes(cpus []int) ([]int, error) {
+	var nodes []int
+
+	nodeDirs, err := lsDirs(numaNodesDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, nodeDir := range nodeDirs {
+		if !strings.HasPrefix(nodeDir, numaNodePrefix) {
+			continue
+		}
+		node, err := strconv.Atoi(strings.TrimPrefix(nodeDir, numaNodePrefix))
+		if err != nil {
+			continue
+		}
+		cpuListFile := fileObject{
+			Path: filepath.Join(numaNodesDir, nodeDir, numaCpuList),
+		}
+		value, err := cpuListFile.Read()
+		if err != nil {
+			continue
+		}
+		nodeCpus, err := parseIndexList(value)
+		if err != nil {
+			continue
+		}
+		for _, cpu := range cpus {
+			if containsInt(nodeCpus, cpu) {
+				nodes = append(nodes, node)
+				break
+			}
+		}
+	}
+	return nodes, nil
+}
+
+// cpusetNumaNodes returns the NUMA nodes a container is bound to by its
+// cpuset, memory nodes first, else nodes of its cpus. No nodes are returned
+// for containers not bound to cpus.
+func cpusetNumaNodes(cpus string, mems string) ([]int, error) {
+	if mems != "" {
+		return parseIndexList(mems)
+	}
+	cpuIDs, err := parseIndexList(cpus)
+	if err != nil || len(cpuIDs) == 0 {
+		return nil, err
+	}
+	return cpusNumaNodes(cpuIDs)
+}
+
+func sameInts(list1 []int, list2 []int) bool {
+	if len(list1) != len(list2) {
+		return false
+	}
+	for i := range list1 {
+		if list1[i] != list2[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// startingContainerNumaNodes returns the NUMA nodes of the container whose
+// endpoint is being created on a network. When several containers may be
+// starting on the network and their nodes differ, or the nodes can't be
+// found, no nodes are returned and no node is preferred.
+func startingContainerNumaNodes(networkID string) []int {
+	var nodes []int
+
+	cpusets, err := startingContainerCpusets(networkID)
+	if err != nil {
+		log.Printf("Fail to find cpuset of container on network %s: %v\n", networkID, err)
+		return nil
+	}
+	for i, cpuset := range cpusets {
+		ctrNodes, err := cpusetNumaNodes(cpuset.CpusetCpus, cpuset.CpusetMems)
+		if err != nil {
+			log.Printf("Fail to find numa nodes of cpuset %+v: %v\n", cpuset, err)
+			return nil
+		}
+		sort.Ints(ctrNodes)
+		if i > 0 && !sameInts(nodes, ctrNodes) {
+			log.Printf("Containers starting on network %s are on different numa nodes\n", networkID)
+			return nil
+		}
+		nodes = ctrNodes
+	}
+	return nodes
+}
+
+// numaLocalVfs returns the VFs, by index, which are on the NUMA nodes. The
+// strict policy fails when there are none, other policies fall back to all
+// the VFs.
+func numaLocalVfs(vfs []int, pciAddrs map[int]string, nodes []int, policy string) ([]int, error) {
+	var local []int
+
+	if len(nodes) == 0 || policy == numaPolicyIgnore {
+		return vfs, nil
+	}
+	for _, index := range vfs {
+		if containsInt(nodes, pciDevNumaNode(pciAddrs[index])) {
+			local = append(local, index)
+		}
+	}
+	if len(local) != 0 {
+		return local, nil
+	}
+	if policy == numaPolicyStrict {
+		return nil, fmt.Errorf("no free VF on numa nodes %v", nodes)
+	}
+	return vfs, nil
+}
+
+// checkEndpointNuma checks that the VF of an endpoint is on one of the
+// NUMA nodes of its container, as a backstop of the placement at
+// CreateEndpoint which can't always find the container. A mismatch is an
+// error with the strict policy and is only logged with the preferred one.
+func checkEndpointNuma(ep *Endpoint_Metadata, nodes []int) error {
+	if ep.Numa == "" || ep.Numa == numaPolicyIgnore ||
+		len(nodes) == 0 || ep.NumaNode < 0 || containsInt(nodes, ep.NumaNode) {
+		return nil
+	}
+	if ep.Numa == numaPolicyStrict {
+		return fmt.Errorf("VF of endpoint %s is on numa node %d, container is on numa nodes %v",
+			ep.EndpointID, ep.NumaNode, nodes)
+	}
+	log.Printf("oci hook: VF of endpoint %s is on numa node %d, container is on numa nodes %v\n",
+		ep.EndpointID, ep.NumaNode, nodes)
+	return nil
+}
@@ -0,0 +1,39 @@
+package driver
+
+import (
+	"testing"
+)
+
+func TestParseIndexList(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected []int
+		valid    bool
+	}{
+		{"", nil, true},
+		{" ", nil, true},
+		{"3", []int{3}, true},
+		{"0-3", []int{0, 1, 2, 3}, true},
+		{"0-1,4,6-7", []int{0, 1, 4, 6, 7}, true},
+		{"2-2", []int{2}, true},
+		{" 1,2 ", []int{1, 2}, true},
+		{"3-1", nil, false},
+		{"-1", nil, false},
+		{"1-", nil, false},
+		{"1,,2", nil, false},
+		{"a-b", nil, false},
+		{"0-3,x", nil, false},
+	}
+	for _, test := range tests {
+		ids, err := parseIndexList(test.value)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%q accepted as %v", test.value, ids)
+			}
+			continue
+		}
+		if err != nil || !sameInts(ids, test.expected) {
+			t.Errorf("%q parsed as %v (%v), expected %v", test.value, ids, err, test.expected)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package driver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/Mellanox/rdmamap"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	rdmaCmDevice        = "rdma_cm"
+	uverbsDevicePrefix  = "uverbs"
+	devicesCgroupDir    = "/sys/fs/cgroup/devices"
+	devicesAllowFile    = "devices.allow"
+	cgroupV2Controllers = "/sys/fs/cgroup/cgroup.controllers"
+
+	// hook docker adds to bind the container netns at its sandbox key
+	dockerSetkeyHook = "libnetwork-setkey"
+)
+
+/* Container state given to OCI hooks on stdin */
+type ociState struct {
+	ID     string `json:"id"`
+	Pid    int    `json:"pid"`
+	Bundle string `json:"bundle"`
+}
+
+type ociHook struct {
+	Path string   `json:"path"`
+	Args []string `json:"args"`
+}
+
+/* Part of the OCI runtime config.json of the container bundle */
+type ociSpec struct {
+	Root struct {
+		Path string `json:"path"`
+	} `json:"root"`
+	Hooks struct {
+		Prestart      []ociHook `json:"prestart"`
+		CreateRuntime []ociHook `json:"createRuntime"`
+	} `json:"hooks"`
+	Linux struct {
+		Resources struct {
+			CPU struct {
+				Cpus string `json:"cpus"`
+				Mems string `json:"mems"`
+			} `json:"cpu"`
+		} `json:"resources"`
+	} `json:"linux"`
+}
+
+// isRdmaAppDevice returns whether an RDMA character device is needed by
+// verbs and rdma_cm applications.
+func isRdmaAppDevice(devPath string) bool {
+	name := filepath.Base(devPath)
+	return strings.HasPrefix(name, uverbsDevicePrefix) || name == rdmaCmDevice
+}
+
+func sameFile(path1 string, path2 string) bool {
+	var st1, st2 syscall.Stat_t
+
+	if syscall.Stat(path1, &st1) != nil || syscall.Stat(path2, &st2) != nil {
+		return false
+	}
+	return st1.Dev == st2.Dev && st1.Ino == st2.Ino
+}
+
+func readOciSpec(bundle string) (*ociSpec, error) {
+	spec := ociSpec{}
+
+	rawData, err := ioutil.ReadFile(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(rawData, &spec)
+	if err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+// containerRootfs returns the path of the root filesystem of a container
+// as seen by prestart hooks. They run before the container pivots to its
+// root, so the root of the container process is still the host one, and
+// the container mounts, such as its /dev and /sys, are under the root path
+// of the bundle in the mount namespace of the container.
+func containerRootfs(pid int, bundle string, spec *ociSpec) string {
+	rootPath := spec.Root.Path
+	if !filepath.IsAbs(rootPath) {
+		rootPath = filepath.Join(bundle, rootPath)
+	}
+	return filepath.Join(fmt.Sprintf("/proc/%d/root", pid), rootPath)
+}
+
+// hasSetkeyHook tells whether docker binds the network namespace of the
+// container at its sandbox key from a hook.
+func (spec *ociSpec) hasSetkeyHook() bool {
+	for _, hook := range append(spec.Hooks.CreateRuntime, spec.Hooks.Prestart...) {
+		for _, arg := range hook.Args {
+			if arg == dockerSetkeyHook {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// netnsBoundIn tells whether a network namespace is bound at a file of one
+// of the directories.
+func netnsBoundIn(nsPath string, dirs map[string]bool) bool {
+	for dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			if sameFile(filepath.Join(dir, file.Name()), nsPath) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// findContainerEndpoints returns metadata of the endpoints joined to the
+// network namespace of a container process. Endpoints are matched by the
+// sandbox key docker binds the namespace at, so the hook fails when it
+// runs before docker bound the namespace of the container.
+func findContainerEndpoints(pid int, spec *ociSpec) ([]*Endpoint_Metadata, error) {
+	var eps []*Endpoint_Metadata
+
+	nsPath := fmt.Sprintf("/proc/%d/ns/net", pid)
+	files, err := filepath.Glob(filepath.Join(endpointRunDir, "*", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	keyDirs := make(map[string]bool)
+	for _, file := range files {
+		rawData, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		meta := Endpoint_Metadata{}
+		err = json.Unmarshal(rawData, &meta)
+		if err != nil || meta.SandboxKey == "" {
+			continue
+		}
+		keyDirs[filepath.Dir(meta.SandboxKey)] = true
+		if sameFile(meta.SandboxKey, nsPath) {
+			eps = append(eps, &meta)
+		}
+	}
+	if len(eps) == 0 && len(keyDirs) != 0 && spec.hasSetkeyHook() &&
+		!netnsBoundIn(nsPath, keyDirs) {
+		return nil, fmt.Errorf("network namespace of pid %d is not bound to a sandbox key yet, "+
+			"the hook has to run after the %s hook of docker", pid, dockerSetkeyHook)
+	}
+	return eps, nil
+}
+
+func devMajorMinor(rdev uint64) (uint64, uint64) {
+	major := (rdev>>8)&0xfff | (rdev>>32)&^0xfff
+	minor := rdev&0xff | (rdev>>12)&^0xff
+	return major, minor
+}
+
+// devicesCgroupPath returns the devices cgroup v1 directory of a process.
+func devicesCgroupPath(pid int) (string, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		/* hierarchy-ID:controller-list:cgroup-path */
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			if controller == "devices" {
+				return filepath.Join(devicesCgroupDir, fields[2]), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no devices cgroup for pid %d", pid)
+}
+
+// containerDevicesCgroup returns the devices cgroup to allow the devices
+// of a container in. cgroup v2 has no devices cgroup files, the devices
+// have to be allowed with --device-cgroup-rule of docker run instead, and
+// no cgroup is returned.
+func containerDevicesCgroup(pid int) (string, error) {
+	cgroupPath, err := devicesCgroupPath(pid)
+	if err == nil {
+		return cgroupPath, nil
+	}
+	if fileExists(cgroupV2Controllers) {
+		log.Printf("oci hook: cgroup v2 host, RDMA devices of pid %d have to be allowed with --device-cgroup-rule\n", pid)
+		return "", nil
+	}
+	return "", err
+}
+
+// injectDevice creates a host character device node in the container
+// and allows it in the container devices cgroup.
+func injectDevice(devPath string, rootfs string, cgroupPath string) error {
+	var st syscall.Stat_t
+
+	err := syscall.Stat(devPath, &st)
+	if err != nil {
+		return err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFCHR {
+		return fmt.Errorf("%s is not a character device", devPath)
+	}
+
+	if cgroupPath != "" {
+		major, minor := devMajorMinor(uint64(st.Rdev))
+		allowFile := fileObject{
+			Path: filepath.Join(cgroupPath, devicesAllowFile),
+		}
+		err = allowFile.Write(fmt.Sprintf("c %d:%d rwm", major, minor))
+		if err != nil {
+			return err
+		}
+	}
+
+	ctrDevPath := filepath.Join(rootfs, devPath)
+	if fileExists(ctrDevPath) {
+		return nil
+	}
+	err = os.MkdirAll(filepath.Dir(ctrDevPath), 0755)
+	if err != nil {
+		return err
+	}
+	err = syscall.Mknod(ctrDevPath, st.Mode, int(st.Rdev))
+	if err != nil {
+		return err
+	}
+	return os.Chmod(ctrDevPath, 0666)
+}
+
+// waitEndpointGid waits until the RDMA device of an endpoint has a GID for
+// the address assigned to the container, which only exists once the
+// address is configured in the container.
+func waitEndpointGid(ep *Endpoint_Metadata, rootfs string) error {
+	timeout, err := parseWaitReady(ep.WaitReady)
+	if err != nil || timeout == 0 || ep.RdmaDevice == "" || ep.Address == "" {
+		return err
+	}
+	ip, _, err := net.ParseCIDR(ep.Address)
+	if err != nil {
+		return err
+	}
+
+	// RDMA device is only visible in the container in exclusive netns mode.
+	classDir := rdmamap.RdmaClassDir
+	if !dirExists(filepath.Join(classDir, ep.RdmaDevice)) {
+		classDir = filepath.Join(rootfs, rdmamap.RdmaClassDir)
+	}
+
+	err = pollUntil(time.Now().Add(timeout), func() error {
+		return checkRdmaGids(classDir, ep.RdmaDevice, ip)
+	})
+	if err != nil {
+		return fmt.Errorf("endpoint %s not ready after %v: %v", ep.EndpointID, timeout, err)
+	}
+	return nil
+}
+
+// containerNumaNodes returns the NUMA nodes of the cpuset of a container,
+// read from its bundle. Docker can't be asked while it starts the
+// container.
+func containerNumaNodes(spec *ociSpec) ([]int, error) {
+	cpu := spec.Linux.Resources.CPU
+	return cpusetNumaNodes(cpu.Cpus, cpu.Mems)
+}
+
+// RunOciHook is the OCI prestart hook. It moves RDMA devices of networks
+// in exclusive rdma netns mode into the container, adds RDMA character
+// devices of the VFs given to the container by the plugin to it, waits
+// for their GIDs when the network has a readiness gate, and checks the
+// NUMA node of the VFs when the network has a NUMA policy.
+func RunOciHook(stateReader io.Reader) error {
+	state := ociState{}
+
+	err := json.NewDecoder(stateReader).Decode(&state)
+	if err != nil {
+		return fmt.Errorf("Fail to decode container state: %v", err)
+	}
+
+	spec, err := readOciSpec(state.Bundle)
+	if err != nil {
+		return fmt.Errorf("Fail to read config of container %s: %v", state.ID, err)
+	}
+	eps, err := findContainerEndpoints(state.Pid, spec)
+	if err != nil {
+		return err
+	}
+	if len(eps) == 0 {
+		return nil
+	}
+
+	rootfs := containerRootfs(state.Pid, state.Bundle, spec)
+	cgroupPath, err := containerDevicesCgroup(state.Pid)
+	if err != nil {
+		return fmt.Errorf("Fail to find devices cgroup of container %s: %v", state.ID, err)
+	}
+
+	var nodes []int
+	for _, ep := range eps {
+		if ep.Numa != "" && ep.Numa != numaPolicyIgnore {
+			nodes, err = containerNumaNodes(spec)
+			if err != nil && ep.Numa == numaPolicyStrict {
+				return fmt.Errorf("Fail to find numa nodes of container %s: %v", state.ID, err)
+			}
+			if err != nil {
+				log.Printf("oci hook: fail to find numa nodes of container %s: %v\n", state.ID, err)
+			}
+			break
+		}
+	}
+
+	for _, ep := range eps {
+		err = checkEndpointNuma(ep, nodes)
+		if err != nil {
+			return err
+		}
+		if ep.RdmaNetns == rdmaNetnsExclusive && ep.RdmaDevice != "" {
+			err = moveRdmaDevToSandbox(ep.RdmaDevice, fmt.Sprintf("/proc/%d/ns/net", state.Pid))
+			if err != nil {
+				return fmt.Errorf("Fail to move rdma device %s to container %s: %v",
+					ep.RdmaDevice, state.ID, err)
+			}
+			log.Printf("oci hook: moved %s to container %s\n", ep.RdmaDevice, state.ID)
+		}
+		for _, devPath := range ep.RdmaCharDevices {
+			err = injectDevice(devPath, rootfs, cgroupPath)
+			if err != nil {
+				return fmt.Errorf("Fail to add %s to container %s: %v", devPath, state.ID, err)
+			}
+			log.Printf("oci hook: added %s of %s to container %s\n", devPath, ep.RdmaDevice, state.ID)
+		}
+		err = waitEndpointGid(ep, rootfs)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
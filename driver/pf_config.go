@@ -0,0 +1,303 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	devlinkEswitchMode = "mode"
+	devlinkInlineMode  = "inline-mode"
+	devlinkEncapMode   = "encap-mode"
+)
+
+var (
+	validEswitchModes = []string{eswitchModeLegacy, eswitchModeSwitchdev}
+	validInlineModes  = []string{"none", "link", "network", "transport"}
+	validEncapModes   = []string{"none", "basic"}
+)
+
+func isValidValue(value string, valid []string) bool {
+	for _, v := range valid {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (cfg *Daemon_Pf_Config) isEmpty() bool {
+	return cfg.NumVfs == 0 && cfg.Eswitch == "" &&
+		cfg.InlineMode == "" && cfg.EncapMode == ""
+}
+
+// eswitchMode returns the eswitch mode of the settings. PFs without devlink
+// eswitch support report no mode and work as legacy ones.
+func (cfg *Daemon_Pf_Config) eswitchMode() string {
+	if cfg.Eswitch == "" {
+		return eswitchModeLegacy
+	}
+	return cfg.Eswitch
+}
+
+// eswitchChanges tells whether the settings change the eswitch mode, inline
+// mode or encap mode of the current ones.
+func (cfg *Daemon_Pf_Config) eswitchChanges(cur *Daemon_Pf_Config) bool {
+	return (cfg.Eswitch != "" && cfg.Eswitch != cur.eswitchMode()) ||
+		(cfg.InlineMode != "" && cfg.InlineMode != cur.InlineMode) ||
+		(cfg.EncapMode != "" && cfg.EncapMode != cur.EncapMode)
+}
+
+func (cfg *Daemon_Pf_Config) hasEswitchConfig() bool {
+	return cfg.Eswitch != "" || cfg.InlineMode != "" || cfg.EncapMode != ""
+}
+
+// pfConfigFromOptions merges the PF section of the daemon configuration
+// with the PF settings given as network options.
+func pfConfigFromOptions(daemonCfg *Daemon_Pf_Config, options map[string]string) (*Daemon_Pf_Config, error) {
+	var err error
+
+	cfg := Daemon_Pf_Config{}
+	if daemonCfg != nil {
+		cfg = *daemonCfg
+	}
+
+	if options[networkNumVfs] != "" {
+		cfg.NumVfs, err = strconv.Atoi(options[networkNumVfs])
+		if err != nil || cfg.NumVfs <= 0 {
+			return nil, fmt.Errorf("Invalid numvfs %s", options[networkNumVfs])
+		}
+	}
+	if options[networkEswitch] != "" {
+		cfg.Eswitch = options[networkEswitch]
+	}
+	if options[networkInlineMode] != "" {
+		cfg.InlineMode = options[networkInlineMode]
+	}
+	if options[networkEncapMode] != "" {
+		cfg.EncapMode = options[networkEncapMode]
+	}
+
+	if cfg.Eswitch != "" && !isValidValue(cfg.Eswitch, validEswitchModes) {
+		return nil, fmt.Errorf("valid eswitch modes are: %v", validEswitchModes)
+	}
+	if cfg.InlineMode != "" && !isValidValue(cfg.InlineMode, validInlineModes) {
+		return nil, fmt.Errorf("valid inline modes are: %v", validInlineModes)
+	}
+	if cfg.EncapMode != "" && !isValidValue(cfg.EncapMode, validEncapModes) {
+		return nil, fmt.Errorf("valid encap modes are: %v", validEncapModes)
+	}
+	return &cfg, nil
+}
+
+// checkPfConfigConflict verifies that PF settings requested by a new network
+// match the settings already applied to the PF by other networks.
+func checkPfConfigConflict(pfNetdevName string, cfg *Daemon_Pf_Config, applied *Daemon_Pf_Config) error {
+	if applied == nil {
+		applied = &Daemon_Pf_Config{}
+	}
+	if cfg.NumVfs != 0 && cfg.NumVfs != applied.NumVfs {
+		return fmt.Errorf("%s is already in use with numvfs %d", pfNetdevName, applied.NumVfs)
+	}
+	if cfg.Eswitch != "" && cfg.Eswitch != applied.eswitchMode() {
+		return fmt.Errorf("%s is already in use with eswitch mode %s", pfNetdevName, applied.eswitchMode())
+	}
+	if cfg.InlineMode != "" && cfg.InlineMode != applied.InlineMode {
+		return fmt.Errorf("%s is already in use with inline mode %s", pfNetdevName, applied.InlineMode)
+	}
+	if cfg.EncapMode != "" && cfg.EncapMode != applied.EncapMode {
+		return fmt.Errorf("%s is already in use with encap mode %s", pfNetdevName, applied.EncapMode)
+	}
+	return nil
+}
+
+func netdevPciAddress(netdevName string) (string, error) {
+	pciDevDir, err := os.Readlink(netDevDeviceDir(netdevName))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(pciDevDir), nil
+}
+
+// devlinkEswitchShow reads the eswitch settings of a PF with the devlink
+// tool of iproute2, which the plugin image ships. The netlink package has
+// no inline and encap mode calls.
+func devlinkEswitchShow(pciAddr string) (*Daemon_Pf_Config, error) {
+	var show map[string]map[string]map[string]interface{}
+
+	out, err := exec.Command("devlink", "-j", "dev", "eswitch", "show", "pci/"+pciAddr).Output()
+	if err != nil {
+		return nil, fmt.Errorf("Fail to get eswitch of %s: %v", pciAddr, err)
+	}
+	err = json.Unmarshal(out, &show)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := show["dev"]["pci/"+pciAddr]
+	if attrs == nil {
+		return nil, fmt.Errorf("eswitch of %s not found", pciAddr)
+	}
+	cfg := Daemon_Pf_Config{}
+	if value, ok := attrs[devlinkEswitchMode]; ok {
+		cfg.Eswitch = fmt.Sprintf("%v", value)
+	}
+	if value, ok := attrs[devlinkInlineMode]; ok {
+		cfg.InlineMode = fmt.Sprintf("%v", value)
+	}
+	if value, ok := attrs[devlinkEncapMode]; ok {
+		cfg.EncapMode = fmt.Sprintf("%v", value)
+	}
+	return &cfg, nil
+}
+
+// devlinkEswitchSet changes the eswitch settings of a PF with the devlink
+// tool of iproute2.
+func devlinkEswitchSet(pciAddr string, cfg *Daemon_Pf_Config) error {
+	args := []string{"dev", "eswitch", "set", "pci/" + pciAddr}
+
+	if cfg.Eswitch != "" {
+		args = append(args, devlinkEswitchMode, cfg.Eswitch)
+	}
+	if cfg.InlineMode != "" {
+		args = append(args, devlinkInlineMode, cfg.InlineMode)
+	}
+	if cfg.EncapMode != "" {
+		args = append(args, devlinkEncapMode, cfg.EncapMode)
+	}
+	return runCommand("devlink", args...)
+}
+
+// readPfConfig returns the current VF count and eswitch settings of a PF.
+func readPfConfig(pfNetdevName string) (*Daemon_Pf_Config, error) {
+
+	pciAddr, err := netdevPciAddress(pfNetdevName)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := devlinkEswitchShow(pciAddr)
+	if err != nil {
+		/* devices without eswitch support only have a VF count */
+		cfg = &Daemon_Pf_Config{}
+	}
+	cfg.NumVfs, err = netdevGetEnabledVFCount(pfNetdevName)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func setPfVfCount(pfNetdevName string, numVfs int) error {
+
+	curVfs, err := netdevGetEnabledVFCount(pfNetdevName)
+	if err != nil {
+		return err
+	}
+	if curVfs == numVfs {
+		return nil
+	}
+	/* VF count can only be changed from zero */
+	if curVfs != 0 {
+		err = netdevSetMaxVFCount(pfNetdevName, 0)
+		if err != nil {
+			return err
+		}
+	}
+	if numVfs == 0 {
+		return nil
+	}
+	return netdevSetMaxVFCount(pfNetdevName, numVfs)
+}
+
+// setPfEswitch changes eswitch settings of a PF through the devlink tool,
+// which has to be installed. VFs have to be unbound from their driver
+// while the eswitch mode changes.
+func setPfEswitch(pfNetdevName string, cfg *Daemon_Pf_Config) error {
+
+	pciAddr, err := netdevPciAddress(pfNetdevName)
+	if err != nil {
+		return err
+	}
+
+	var unboundVfs []string
+	vfDirs, _ := GetVfPciDevList(pfNetdevName)
+	for _, vfDir := range vfDirs {
+		vfPciDev := vfPCIDevNameFromVfDir(pfNetdevName, vfDir)
+		if vfPciDev == "" {
+			continue
+		}
+		if unbindVF(pfNetdevName, vfPciDev) == nil {
+			unboundVfs = append(unboundVfs, vfPciDev)
+		}
+	}
+
+	err = devlinkEswitchSet(pciAddr, cfg)
+
+	for _, vfPciDev := range unboundVfs {
+		bindVF(pfNetdevName, vfPciDev)
+	}
+	return err
+}
+
+// applyPfConfig configures the VF count and eswitch of a PF in the order
+// required by the device: VF count first, then eswitch mode with VFs
+// unbound. It returns the settings found before.
+func applyPfConfig(pfNetdevName string, cfg *Daemon_Pf_Config) (*Daemon_Pf_Config, error) {
+
+	prev, err := readPfConfig(pfNetdevName)
+	if err != nil {
+		return nil, err
+	}
+
+	numVfs := cfg.NumVfs
+	if numVfs == 0 && prev.NumVfs == 0 {
+		numVfs, err = netdevGetMaxVFCount(pfNetdevName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if numVfs != 0 {
+		maxVfs, _ := netdevGetMaxVFCount(pfNetdevName)
+		if numVfs > maxVfs {
+			return nil, fmt.Errorf("%s supports at most %d vfs", pfNetdevName, maxVfs)
+		}
+		err = setPfVfCount(pfNetdevName, numVfs)
+		if err != nil {
+			return nil, fmt.Errorf("Fail to set vf count of %s: %v", pfNetdevName, err)
+		}
+	}
+
+	if cfg.eswitchChanges(prev) {
+		err = setPfEswitch(pfNetdevName, cfg)
+		if err != nil {
+			setPfVfCount(pfNetdevName, prev.NumVfs)
+			return nil, fmt.Errorf("Fail to set eswitch of %s: %v", pfNetdevName, err)
+		}
+	}
+	log.Printf("Applied PF config %s: %+v previous: %+v\n", pfNetdevName, cfg, prev)
+	return prev, nil
+}
+
+// restorePfConfig returns a PF to the settings it had before the plugin
+// configured it.
+func restorePfConfig(pfNetdevName string, prev *Daemon_Pf_Config) error {
+
+	err := setPfVfCount(pfNetdevName, 0)
+	if err != nil {
+		return err
+	}
+	if prev.hasEswitchConfig() {
+		err = setPfEswitch(pfNetdevName, prev)
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Restored PF config %s: %+v\n", pfNetdevName, prev)
+	return setPfVfCount(pfNetdevName, prev.NumVfs)
+}
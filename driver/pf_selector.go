@@ -0,0 +1,186 @@
+package driver
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	pfSelectorVendor = "vendor"
+	pfSelectorDevice = "device"
+	pfSelectorDriver = "driver"
+	pfSelectorPci    = "pci"
+	pfSelectorSpeed  = "speed"
+	pfSelectorPort   = "port"
+	pfSelectorNuma   = "numa"
+
+	// netdevice value resolved to the only PF of the host
+	pfSelectorAuto = "auto"
+
+	netdevPhysFn = "physfn"
+)
+
+var pfSelectorKeys = []string{
+	pfSelectorVendor, pfSelectorDevice, pfSelectorDriver, pfSelectorPci,
+	pfSelectorSpeed, pfSelectorPort, pfSelectorNuma,
+}
+
+// pfSelector matches PF netdevices by their properties instead of by
+// name. Empty fields match any PF.
+type pfSelector struct {
+	vendor    string // PCI vendor id, such as 15b3
+	device    string // PCI device id
+	driver    string
+	pciPrefix string
+	speed     int // Mb/s, 0 when not set
+	port      int // PCI function of the PF, -1 when not set
+	numa      int // -1 when not set
+}
+
+func parsePciID(value string) string {
+	return strings.TrimPrefix(strings.ToLower(strings.TrimSpace(value)), "0x")
+}
+
+// parsePfSelector parses a selector such as driver=mlx5_core,numa=0.
+func parsePfSelector(value string) (*pfSelector, error) {
+	var err error
+
+	sel := pfSelector{port: -1, numa: -1}
+	if value == pfSelectorAuto {
+		return &sel, nil
+	}
+
+	for _, term := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(term), "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("Invalid PF selector term %s, valid format is key=value", term)
+		}
+		switch kv[0] {
+		case pfSelectorVendor:
+			sel.vendor = parsePciID(kv[1])
+		case pfSelectorDevice:
+			sel.device = parsePciID(kv[1])
+		case pfSelectorDriver:
+			sel.driver = kv[1]
+		case pfSelectorPci:
+			sel.pciPrefix = kv[1]
+		case pfSelectorSpeed:
+			sel.speed, err = strconv.Atoi(kv[1])
+			if err != nil || sel.speed <= 0 {
+				return nil, fmt.Errorf("Invalid speed %s, valid format is Mb/s such as 100000", kv[1])
+			}
+		case pfSelectorPort:
+			sel.port, err = strconv.Atoi(kv[1])
+			if err != nil || sel.port < 0 {
+				return nil, fmt.Errorf("Invalid port %s", kv[1])
+			}
+		case pfSelectorNuma:
+			sel.numa, err = strconv.Atoi(kv[1])
+			if err != nil || sel.numa < 0 {
+				return nil, fmt.Errorf("Invalid numa node %s", kv[1])
+			}
+		default:
+			return nil, fmt.Errorf("valid PF selector keys are: %s", strings.Join(pfSelectorKeys, ", "))
+		}
+	}
+	return &sel, nil
+}
+
+func pciDevID(pciAddr string, attr string) string {
+	idFile := fileObject{
+		Path: filepath.Join(pciDevicesDir, pciAddr, attr),
+	}
+	value, err := idFile.Read()
+	if err != nil {
+		return ""
+	}
+	return parsePciID(value)
+}
+
+func (sel *pfSelector) match(netdevName string) bool {
+	pciAddr, err := netdevPciAddress(netdevName)
+	if err != nil {
+		return false
+	}
+	if sel.vendor != "" && pciDevID(pciAddr, pfSelectorVendor) != sel.vendor {
+		return false
+	}
+	if sel.device != "" && pciDevID(pciAddr, pfSelectorDevice) != sel.device {
+		return false
+	}
+	if sel.driver != "" && pciDevDriver(pciAddr) != sel.driver {
+		return false
+	}
+	if sel.pciPrefix != "" && !strings.HasPrefix(pciAddr, sel.pciPrefix) {
+		return false
+	}
+	if sel.speed != 0 && netdevReadAttr(netdevName, pfSelectorSpeed) != strconv.Itoa(sel.speed) {
+		return false
+	}
+	if sel.port >= 0 {
+		port, err := pciFunctionNumber(pciAddr)
+		if err != nil || port != sel.port {
+			return false
+		}
+	}
+	if sel.numa >= 0 && pciDevNumaNode(pciAddr) != sel.numa {
+		return false
+	}
+	return true
+}
+
+// isPfNetdev tells whether a netdevice is of a PCI function which is not a
+// VF.
+func isPfNetdev(netdevName string) bool {
+	if !dirExists(netDevDeviceDir(netdevName)) {
+		return false
+	}
+	return !dirExists(filepath.Join(netDevDeviceDir(netdevName), netdevPhysFn))
+}
+
+// selectPfs returns the PF netdevices which match the selector, sorted by
+// name. Only SRIOV capable PFs are selected when sriov is set.
+func selectPfs(sel *pfSelector, sriov bool) ([]string, error) {
+	var pfs []string
+
+	netdevs, err := lsDirs(netSysDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, netdevName := range netdevs {
+		if !isPfNetdev(netdevName) || checkMultiPortDevice(netdevName) {
+			continue
+		}
+		if sriov && !IsSRIOVSupported(netdevName) {
+			continue
+		}
+		if sel.match(netdevName) {
+			pfs = append(pfs, netdevName)
+		}
+	}
+	sort.Strings(pfs)
+	return pfs, nil
+}
+
+// resolvePfSelector returns the single PF matched by a selector.
+func resolvePfSelector(value string, sriov bool) (string, error) {
+	sel, err := parsePfSelector(value)
+	if err != nil {
+		return "", err
+	}
+	pfs, err := selectPfs(sel, sriov)
+	if err != nil {
+		return "", err
+	}
+	if len(pfs) == 0 {
+		return "", fmt.Errorf("no PF matches selector %s", value)
+	}
+	if len(pfs) > 1 {
+		return "", fmt.Errorf("selector %s is ambiguous, it matches PFs: %s",
+			value, strings.Join(pfs, ", "))
+	}
+	return pfs[0], nil
+}
@@ -0,0 +1,88 @@
+package driver
+
+import (
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"log"
+	"runtime"
+)
+
+const (
+	rdmaNetnsExclusive = "exclusive"
+)
+
+// checkRdmaNetnsMode verifies that the RDMA subsystem is in the netns mode
+// requested by a network.
+func checkRdmaNetnsMode(mode string) error {
+	if mode == "" {
+		return nil
+	}
+	if mode != rdmaNetnsExclusive {
+		return fmt.Errorf("valid rdma_netns modes are: %s", rdmaNetnsExclusive)
+	}
+
+	curMode, err := netlink.RdmaSystemGetNetnsMode()
+	if err != nil {
+		return fmt.Errorf("Fail to get rdma netns mode: %v", err)
+	}
+	if curMode != rdmaNetnsExclusive {
+		return fmt.Errorf("rdma subsystem is in %s netns mode, exclusive mode is required", curMode)
+	}
+	return nil
+}
+
+// moveRdmaDevToSandbox moves an RDMA device into the network namespace at
+// nsPath. The sandbox key of Docker is only bound to the namespace after
+// Join, so the OCI hook passes the namespace of the container process.
+func moveRdmaDevToSandbox(rdmaDev string, nsPath string) error {
+
+	link, err := netlink.RdmaLinkByName(rdmaDev)
+	if err != nil {
+		return err
+	}
+
+	sandboxNs, err := netns.GetFromPath(nsPath)
+	if err != nil {
+		return err
+	}
+	defer sandboxNs.Close()
+
+	return netlink.RdmaLinkSetNsFd(link, uint32(sandboxNs.Fd()))
+}
+
+// returnRdmaDevFromSandbox moves an RDMA device back from the network
+// namespace of the container and checks that it is in the host namespace.
+func returnRdmaDevFromSandbox(rdmaDev string, sandboxKey string) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origNs, err := netns.Get()
+	if err != nil {
+		return err
+	}
+	defer origNs.Close()
+
+	// Once the sandbox is gone, the kernel returns the device by itself.
+	sandboxNs, err := netns.GetFromPath(sandboxKey)
+	if err == nil {
+		err = netns.Set(sandboxNs)
+		if err == nil {
+			link, err2 := netlink.RdmaLinkByName(rdmaDev)
+			if err2 == nil {
+				err2 = netlink.RdmaLinkSetNsFd(link, uint32(origNs.Fd()))
+				if err2 != nil {
+					log.Printf("Fail to move rdma device %s to host: %v\n", rdmaDev, err2)
+				}
+			}
+			netns.Set(origNs)
+		}
+		sandboxNs.Close()
+	}
+
+	_, err = netlink.RdmaLinkByName(rdmaDev)
+	if err != nil {
+		return fmt.Errorf("rdma device %s has not returned to host: %v", rdmaDev, err)
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package driver
+
+import (
+	"fmt"
+	"github.com/Mellanox/rdmamap"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	rdmaCmConfigDir = "/sys/kernel/config/rdma_cm"
+
+	gidTypeRoceV1 = "v1"
+	gidTypeRoceV2 = "v2"
+)
+
+var rdmaCmRoceModes = map[string]string{
+	gidTypeRoceV1: "IB/RoCE v1",
+	gidTypeRoceV2: "RoCE v2",
+}
+
+// rdmaTuning holds the RDMA settings of a network, applied to every port
+// of the RDMA device of an endpoint.
+type rdmaTuning struct {
+	hopLimit int    // 0 when not set
+	tos      int    // -1 when not set
+	gidType  string // v1 or v2, empty when not set
+}
+
+type rdmaAttr struct {
+	path  string
+	value string
+}
+
+// rdmaTuningState records the RDMA attributes changed for an endpoint, by
+// tuning or pkey settings, so that they can be reverted on release.
+type rdmaTuningState struct {
+	prevAttrs []rdmaAttr
+	cmDirs    []string // rdma_cm configfs groups created
+}
+
+func parseRdmaTuning(options map[string]string) (*rdmaTuning, error) {
+	tuning := rdmaTuning{tos: -1}
+
+	if options[roceHopLimit] != "" {
+		value, err := strconv.Atoi(options[roceHopLimit])
+		if err != nil || value < 0 || value > 255 {
+			return nil, fmt.Errorf("Valid range of rocehoplimit is: [0..255]")
+		}
+		tuning.hopLimit = value
+	}
+	if options[roceTos] != "" {
+		value, err := strconv.Atoi(options[roceTos])
+		if err != nil || value < 0 || value > 255 {
+			return nil, fmt.Errorf("Valid range of roce_tos is: [0..255]")
+		}
+		tuning.tos = value
+	}
+	if options[roceGidType] != "" {
+		if _, ok := rdmaCmRoceModes[options[roceGidType]]; !ok {
+			return nil, fmt.Errorf("valid roce_gid_type values are: %s and %s", gidTypeRoceV1, gidTypeRoceV2)
+		}
+		tuning.gidType = options[roceGidType]
+	}
+	return &tuning, nil
+}
+
+func (tuning *rdmaTuning) isEmpty() bool {
+	return tuning == nil ||
+		(tuning.hopLimit == 0 && tuning.tos < 0 && tuning.gidType == "")
+}
+
+func (state *rdmaTuningState) writeAttr(path string, value string) error {
+	attrFile := fileObject{
+		Path: path,
+	}
+
+	prev, err := attrFile.Read()
+	if err != nil {
+		return err
+	}
+	err = attrFile.Write(value)
+	if err != nil {
+		return err
+	}
+	state.prevAttrs = append(state.prevAttrs, rdmaAttr{path: path, value: strings.TrimSpace(prev)})
+	return nil
+}
+
+// rdmaCmPortDir returns the rdma_cm configfs directory of a port, creating
+// the configfs group of the device when needed.
+func (state *rdmaTuningState) rdmaCmPortDir(rdmaDev string, port string) (string, error) {
+	if !dirExists(rdmaCmConfigDir) {
+		return "", fmt.Errorf("rdma_cm configfs is not available at %s", rdmaCmConfigDir)
+	}
+
+	devDir := filepath.Join(rdmaCmConfigDir, rdmaDev)
+	if !dirExists(devDir) {
+		err := os.Mkdir(devDir, 0755)
+		if err != nil {
+			return "", err
+		}
+		state.cmDirs = append(state.cmDirs, devDir)
+	}
+	return filepath.Join(devDir, "ports", port), nil
+}
+
+func (tuning *rdmaTuning) applyPort(state *rdmaTuningState, rdmaDev string, port string) error {
+	devDir := filepath.Join(rdmamap.RdmaClassDir, rdmaDev)
+
+	if tuning.hopLimit != 0 {
+		err := state.writeAttr(filepath.Join(devDir, "ttl", port, "ttl"), strconv.Itoa(tuning.hopLimit))
+		if err != nil {
+			return fmt.Errorf("Fail to set hop limit: %v", err)
+		}
+	}
+	if tuning.tos >= 0 {
+		err := state.writeAttr(filepath.Join(devDir, "tc", port, "traffic_class"), strconv.Itoa(tuning.tos))
+		if err != nil {
+			return fmt.Errorf("Fail to set traffic class: %v", err)
+		}
+	}
+
+	if tuning.tos < 0 && tuning.gidType == "" {
+		return nil
+	}
+	cmPortDir, err := state.rdmaCmPortDir(rdmaDev, port)
+	if err != nil {
+		return err
+	}
+	if tuning.tos >= 0 {
+		err = state.writeAttr(filepath.Join(cmPortDir, "default_roce_tos"), strconv.Itoa(tuning.tos))
+		if err != nil {
+			return fmt.Errorf("Fail to set rdma_cm tos: %v", err)
+		}
+	}
+	if tuning.gidType != "" {
+		err = state.writeAttr(filepath.Join(cmPortDir, "default_roce_mode"), rdmaCmRoceModes[tuning.gidType])
+		if err != nil {
+			return fmt.Errorf("Fail to set rdma_cm roce mode: %v", err)
+		}
+	}
+	return nil
+}
+
+// apply configures all ports of the RDMA device of a netdevice.
+func (tuning *rdmaTuning) apply(netdevName string) (*rdmaTuningState, error) {
+	if tuning.isEmpty() {
+		return nil, nil
+	}
+
+	rdmaDev, err := rdmamap.GetRdmaDeviceForNetdevice(netdevName)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to find rdma device of %s: %v", netdevName, err)
+	}
+	ports, err := lsDirs(filepath.Join(rdmamap.RdmaClassDir, rdmaDev, "ports"))
+	if err != nil {
+		return nil, err
+	}
+
+	state := &rdmaTuningState{}
+	for _, port := range ports {
+		err = tuning.applyPort(state, rdmaDev, port)
+		if err != nil {
+			state.revert()
+			return nil, fmt.Errorf("%s port %s: %v", rdmaDev, port, err)
+		}
+	}
+	log.Printf("Applied rdma tuning %+v to %s\n", *tuning, rdmaDev)
+	return state, nil
+}
+
+func (state *rdmaTuningState) toDb() *DB_Rdma_State {
+	if state == nil {
+		return nil
+	}
+
+	dbState := &DB_Rdma_State{CmDirs: state.cmDirs}
+	for _, attr := range state.prevAttrs {
+		dbState.PrevAttrs = append(dbState.PrevAttrs, DB_Rdma_Attr{Path: attr.path, Value: attr.value})
+	}
+	return dbState
+}
+
+// rdmaStateFromDb rebuilds the state of an endpoint created before the
+// plugin restarted, so that its settings are still reverted on release.
+func rdmaStateFromDb(dbState *DB_Rdma_State) *rdmaTuningState {
+	if dbState == nil {
+		return nil
+	}
+
+	state := &rdmaTuningState{cmDirs: dbState.CmDirs}
+	for _, attr := range dbState.PrevAttrs {
+		state.prevAttrs = append(state.prevAttrs, rdmaAttr{path: attr.Path, value: attr.Value})
+	}
+	return state
+}
+
+// revert restores the settings found before the tuning was applied.
+func (state *rdmaTuningState) revert() {
+	if state == nil {
+		return
+	}
+
+	for i := len(state.prevAttrs) - 1; i >= 0; i-- {
+		attrFile := fileObject{
+			Path: state.prevAttrs[i].path,
+		}
+		err := attrFile.Write(state.prevAttrs[i].value)
+		if err != nil {
+			log.Printf("Fail to restore %s: %v\n", state.prevAttrs[i].path, err)
+		}
+	}
+	for _, dir := range state.cmDirs {
+		os.Remove(dir)
+	}
+	state.prevAttrs = nil
+	state.cmDirs = nil
+}
@@ -0,0 +1,209 @@
+package driver
+
+import (
+	"fmt"
+	"github.com/Mellanox/rdmamap"
+	"github.com/vishvananda/netlink"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	readyPollInterval = 100 * time.Millisecond
+)
+
+func parseWaitReady(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("Invalid wait_ready %s, valid format is a duration such as 5s", value)
+	}
+	return timeout, nil
+}
+
+// pollUntil calls check until it succeeds or the deadline passes, and
+// returns the last error of check on timeout.
+func pollUntil(deadline time.Time, check func() error) error {
+	for {
+		err := check()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(readyPollInterval)
+	}
+}
+
+// rdmaPortGids returns the non zero GIDs of an RDMA device port found
+// under the given sysfs class directory.
+func rdmaPortGids(classDir string, rdmaDev string, port string) []net.IP {
+	var gids []net.IP
+
+	gidsDir := filepath.Join(classDir, rdmaDev, "ports", port, "gids")
+	indexes, err := lsDirs(gidsDir)
+	if err != nil {
+		return nil
+	}
+	for _, index := range indexes {
+		gidFile := fileObject{
+			Path: filepath.Join(gidsDir, index),
+		}
+		value, err := gidFile.Read()
+		if err != nil {
+			continue
+		}
+		gid := net.ParseIP(strings.TrimSpace(value))
+		if gid != nil && !gid.IsUnspecified() {
+			gids = append(gids, gid)
+		}
+	}
+	return gids
+}
+
+// roceDefaultGid returns the default GID of a RoCE device, which the kernel
+// derives from the IPv6 link-local address of the MAC address of its
+// netdevice. InfiniBand devices have no such GID and get nil.
+func roceDefaultGid(rdmaDev string, hwAddr net.HardwareAddr) net.IP {
+	if len(hwAddr) != 6 || hwAddr.String() == "00:00:00:00:00:00" {
+		return nil
+	}
+	ports, err := lsDirs(filepath.Join(rdmamap.RdmaClassDir, rdmaDev, "ports"))
+	if err != nil || len(ports) == 0 {
+		return nil
+	}
+	linkLayerFile := fileObject{
+		Path: filepath.Join(rdmamap.RdmaClassDir, rdmaDev, "ports", ports[0], "link_layer"),
+	}
+	linkLayer, err := linkLayerFile.Read()
+	if err != nil || strings.TrimSpace(linkLayer) != "Ethernet" {
+		return nil
+	}
+
+	gid := make(net.IP, net.IPv6len)
+	gid[0] = 0xfe
+	gid[1] = 0x80
+	gid[8] = hwAddr[0] ^ 0x02
+	gid[9] = hwAddr[1]
+	gid[10] = hwAddr[2]
+	gid[11] = 0xff
+	gid[12] = 0xfe
+	copy(gid[13:], hwAddr[3:])
+	return gid
+}
+
+func checkRdmaGids(classDir string, rdmaDev string, ip net.IP) error {
+	ports, err := lsDirs(filepath.Join(classDir, rdmaDev, "ports"))
+	if err != nil {
+		return fmt.Errorf("rdma device %s has no ports: %v", rdmaDev, err)
+	}
+	for _, port := range ports {
+		gids := rdmaPortGids(classDir, rdmaDev, port)
+		if len(gids) == 0 {
+			return fmt.Errorf("rdma device %s port %s has no valid GID", rdmaDev, port)
+		}
+		if ip == nil {
+			continue
+		}
+		found := false
+		for _, gid := range gids {
+			if gid.Equal(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("rdma device %s port %s has no GID for %s", rdmaDev, port, ip)
+		}
+	}
+	return nil
+}
+
+func checkNetdevReady(netdevName string, pfNetdevName string) error {
+	link, err := netlink.LinkByName(netdevName)
+	if err != nil {
+		return fmt.Errorf("netdevice %s does not exist", netdevName)
+	}
+	pfLink, err := netlink.LinkByName(pfNetdevName)
+	if err != nil || pfLink.Attrs().OperState != netlink.OperUp {
+		/* VF link can't come up while the PF link is down */
+		return nil
+	}
+	if link.Attrs().OperState != netlink.OperUp {
+		return fmt.Errorf("netdevice %s link is down", netdevName)
+	}
+	return nil
+}
+
+// readyTarget is a netdevice which Join waits for. It is copied out of the
+// endpoint, so that waiting runs without the driver lock.
+type readyTarget struct {
+	devName      string
+	pfNetdevName string
+}
+
+func newReadyTarget(genNw *genericNetwork, endpoint *ptEndpoint) readyTarget {
+	target := readyTarget{
+		devName:      endpoint.devName,
+		pfNetdevName: genNw.ndevName,
+	}
+	if endpoint.pf != "" {
+		target.pfNetdevName = endpoint.pf
+	}
+	return target
+}
+
+// waitEndpointReady waits until the netdevice of an endpoint exists, its
+// link is up when the PF link is up, and its RDMA device, if any, has a
+// valid GID on every port, including the default RoCE GID of the
+// netdevice. The GID of the container address cannot be checked here as
+// the address is configured after Join; waitEndpointGid of the OCI hook
+// waits for it.
+func waitEndpointReady(target readyTarget, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	devName := target.devName
+	pfNetdevName := target.pfNetdevName
+
+	err := pollUntil(deadline, func() error {
+		_, err := netlink.LinkByName(devName)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("endpoint not ready after %v: netdevice %s does not exist", timeout, devName)
+	}
+
+	// Link has to be up in the host to check that it comes up, it is
+	// brought up again in the container.
+	link, err := netlink.LinkByName(devName)
+	if err == nil && devName != pfNetdevName {
+		netlink.LinkSetUp(link)
+	}
+	err = pollUntil(deadline, func() error {
+		return checkNetdevReady(devName, pfNetdevName)
+	})
+	if err != nil {
+		return fmt.Errorf("endpoint not ready after %v: %v", timeout, err)
+	}
+
+	rdmaDev, err := rdmamap.GetRdmaDeviceForNetdevice(devName)
+	if err != nil || rdmaDev == "" {
+		/* not an RDMA device */
+		return nil
+	}
+	var gid net.IP
+	if link != nil {
+		gid = roceDefaultGid(rdmaDev, link.Attrs().HardwareAddr)
+	}
+	err = pollUntil(deadline, func() error {
+		return checkRdmaGids(rdmamap.RdmaClassDir, rdmaDev, gid)
+	})
+	if err != nil {
+		return fmt.Errorf("endpoint not ready after %v: %v", timeout, err)
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+package driver
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/go-plugins-helpers/network"
+	"log"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sfStateActive   = "active"
+	sfStateInactive = "inactive"
+
+	sfNetdevWaitTime = 10 * time.Second
+)
+
+// sfManager performs the devlink operations of the subfunction lifecycle.
+type sfManager interface {
+	AddSf(pciAddr string, pfNum int, sfNum int) (string, error)
+	SetSfHwAddr(port string, hwAddr string) error
+	SetSfRate(port string, txMax string) error
+	SetSfState(port string, state string) error
+	GetSfState(port string) (string, error)
+	DelSf(port string) error
+}
+
+type devlinkSfManager struct{}
+
+// sfMgr is the subfunction manager used by sf networks.
+var sfMgr sfManager = devlinkSfManager{}
+
+// sfNetdevWait waits for the netdevice of an activated subfunction.
+var sfNetdevWait = waitForNetdevByHwAddr
+
+type sfNetwork struct {
+	genNw   *genericNetwork
+	pciAddr string
+	pfNum   int
+	rate    string
+}
+
+// PF netdevice to subfunction numbers in use map
+var sfNumsInUse map[string]map[int]bool
+
+func devlinkPortJSON(args ...string) (map[string]map[string]interface{}, error) {
+	var out map[string]map[string]interface{}
+
+	rawOut, err := exec.Command("devlink", append([]string{"-j", "port"}, args...)...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("devlink port %s failed: %v", strings.Join(args, " "), err)
+	}
+	err = json.Unmarshal(rawOut, &out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (m devlinkSfManager) AddSf(pciAddr string, pfNum int, sfNum int) (string, error) {
+	out, err := devlinkPortJSON("add", "pci/"+pciAddr, "flavour", "pcisf",
+		"pfnum", strconv.Itoa(pfNum), "sfnum", strconv.Itoa(sfNum))
+	if err != nil {
+		return "", err
+	}
+	for port := range out["port"] {
+		return port, nil
+	}
+	return "", fmt.Errorf("no port returned for sf %d of %s", sfNum, pciAddr)
+}
+
+func (m devlinkSfManager) SetSfHwAddr(port string, hwAddr string) error {
+	return runCommand("devlink", "port", "function", "set", port, "hw_addr", hwAddr)
+}
+
+func (m devlinkSfManager) SetSfRate(port string, txMax string) error {
+	return runCommand("devlink", "port", "function", "rate", "set", port, "tx_max", txMax)
+}
+
+func (m devlinkSfManager) SetSfState(port string, state string) error {
+	return runCommand("devlink", "port", "function", "set", port, "state", state)
+}
+
+func (m devlinkSfManager) GetSfState(port string) (string, error) {
+	out, err := devlinkPortJSON("show", port)
+	if err != nil {
+		return "", err
+	}
+	attrs, ok := out["port"][port].(map[string]interface{})
+	if !ok {
+		return "", fmt.Errorf("sf port %s not found", port)
+	}
+	function, ok := attrs["function"].(map[string]interface{})
+	if !ok {
+		return "", fmt.Errorf("sf port %s has no function", port)
+	}
+	return fmt.Sprintf("%v", function["state"]), nil
+}
+
+func (m devlinkSfManager) DelSf(port string) error {
+	return runCommand("devlink", "port", "del", port)
+}
+
+// pciFunctionNumber returns the function number of a PCI address
+// such as 0000:03:00.1, which is the pfnum of the PF on the device.
+func pciFunctionNumber(pciAddr string) (int, error) {
+	pos := strings.LastIndex(pciAddr, ".")
+	if pos < 0 {
+		return 0, fmt.Errorf("Invalid pci address %s", pciAddr)
+	}
+	return strconv.Atoi(pciAddr[pos+1:])
+}
+
+func randomHwAddr() (string, error) {
+	hwAddr := make(net.HardwareAddr, 6)
+
+	_, err := rand.Read(hwAddr)
+	if err != nil {
+		return "", err
+	}
+	/* locally administered unicast address */
+	hwAddr[0] = (hwAddr[0] | 0x02) & 0xfe
+	return hwAddr.String(), nil
+}
+
+func waitForNetdevByHwAddr(hwAddr string, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		link, err := findLinkByHwAddr(hwAddr)
+		if err == nil {
+			return link.Attrs().Name, nil
+		}
+		if time.Now().After(deadline) {
+			return "", err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func pfSfNums(pfNetdevName string) map[int]bool {
+	if len(sfNumsInUse) == 0 {
+		sfNumsInUse = make(map[string]map[int]bool)
+	}
+	if sfNumsInUse[pfNetdevName] == nil {
+		sfNumsInUse[pfNetdevName] = make(map[int]bool)
+	}
+	return sfNumsInUse[pfNetdevName]
+}
+
+func allocSfNum(pfNetdevName string) int {
+	sfNums := pfSfNums(pfNetdevName)
+
+	sfNum := 1
+	for sfNums[sfNum] {
+		sfNum++
+	}
+	sfNums[sfNum] = true
+	return sfNum
+}
+
+func freeSfNum(pfNetdevName string, sfNum int) {
+	delete(sfNumsInUse[pfNetdevName], sfNum)
+}
+
+func (nw *sfNetwork) getGenNw() *genericNetwork {
+	return nw.genNw
+}
+
+func (nw *sfNetwork) CreateNetwork(d *driver, genNw *genericNetwork,
+	nid string, options map[string]string,
+	ipv4Data *network.IPAMData) error {
+	var err error
+
+	ndevName := options[networkDevice]
+
+	nw.pciAddr, err = netdevPciAddress(ndevName)
+	if err != nil {
+		return fmt.Errorf("Fail to find pci device of %s: %v", ndevName, err)
+	}
+	nw.pfNum, err = pciFunctionNumber(nw.pciAddr)
+	if err != nil {
+		return err
+	}
+
+	eswitch, err := devlinkEswitchShow(nw.pciAddr)
+	if err != nil || eswitch.Eswitch != eswitchModeSwitchdev {
+		return fmt.Errorf("sf mode requires switchdev eswitch mode on %s", ndevName)
+	}
+
+	nw.rate = options[networkSfRate]
+	nw.genNw = genNw
+
+	err = SetPFLinkUp(ndevName)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("SF CreateNetwork : [%s] IPv4Data : [ %+v ]\n", nw.genNw.id, nw.genNw.IPv4Data)
+	return nil
+}
+
+func (nw *sfNetwork) DeleteNetwork(d *driver, req *network.DeleteNetworkRequest) {
+
+}
+
+// deleteSf deactivates, if needed, and deletes a subfunction port.
+func (nw *sfNetwork) deleteSf(port string, active bool) {
+	if active {
+		err := sfMgr.SetSfState(port, sfStateInactive)
+		if err != nil {
+			log.Printf("Fail to deactivate sf %s: %v\n", port, err)
+		}
+	}
+	err := sfMgr.DelSf(port)
+	if err != nil {
+		log.Printf("Fail to delete sf %s: %v\n", port, err)
+	}
+}
+
+func (nw *sfNetwork) CreateEndpoint(r *network.CreateEndpointRequest) (*network.CreateEndpointResponse, error) {
+	var err error
+
+	hwAddr := r.Interface.MacAddress
+	if hwAddr == "" {
+		hwAddr, err = randomHwAddr()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sfNum := allocSfNum(nw.genNw.ndevName)
+	port, err := sfMgr.AddSf(nw.pciAddr, nw.pfNum, sfNum)
+	if err != nil {
+		freeSfNum(nw.genNw.ndevName, sfNum)
+		return nil, fmt.Errorf("Fail to add sf err = %v", err)
+	}
+
+	err = sfMgr.SetSfHwAddr(port, hwAddr)
+	if err == nil && nw.rate != "" {
+		err = sfMgr.SetSfRate(port, nw.rate)
+	}
+	if err == nil {
+		err = sfMgr.SetSfState(port, sfStateActive)
+	}
+	if err != nil {
+		nw.deleteSf(port, false)
+		freeSfNum(nw.genNw.ndevName, sfNum)
+		return nil, fmt.Errorf("Fail to configure sf %s err = %v", port, err)
+	}
+
+	netdevName, err := sfNetdevWait(hwAddr, sfNetdevWaitTime)
+	if err != nil {
+		nw.deleteSf(port, true)
+		freeSfNum(nw.genNw.ndevName, sfNum)
+		return nil, fmt.Errorf("sf %s netdevice did not show up: %v", port, err)
+	}
+
+	log.Printf("AllocSF PF [ %+v ] sf:%d port: %s netdev: %s\n",
+		nw.genNw.ndevName, sfNum, port, netdevName)
+
+	ndev := &ptEndpoint{
+		devName:      netdevName,
+		HardwareAddr: hwAddr,
+		Address:      r.Interface.Address,
+		sfNum:        sfNum,
+		sfPort:       port,
+	}
+	nw.genNw.ndevEndpoints[r.EndpointID] = ndev
+
+	endpointInterface := &network.EndpointInterface{}
+	if r.Interface.MacAddress == "" {
+		endpointInterface.MacAddress = hwAddr
+	}
+	resp := &network.CreateEndpointResponse{Interface: endpointInterface}
+
+	log.Printf("SF CreateEndpoint resp interface: [ %+v ]\n", resp.Interface)
+	return resp, nil
+}
+
+func (nw *sfNetwork) DeleteEndpoint(endpoint *ptEndpoint) {
+
+	nw.deleteSf(endpoint.sfPort, true)
+	freeSfNum(nw.genNw.ndevName, endpoint.sfNum)
+}
+
+// RestoreEndpoint takes over a subfunction created before the plugin
+// restarted.
+func (nw *sfNetwork) RestoreEndpoint(id string, dbEp *DB_Endpoint) error {
+
+	state, err := sfMgr.GetSfState(dbEp.SfPort)
+	if err != nil {
+		return err
+	}
+	if state != sfStateActive {
+		nw.deleteSf(dbEp.SfPort, false)
+		return fmt.Errorf("sf %s is %s", dbEp.SfPort, state)
+	}
+
+	pfSfNums(nw.genNw.ndevName)[dbEp.SfNum] = true
+	nw.genNw.ndevEndpoints[id] = &ptEndpoint{
+		devName:      dbEp.DevName,
+		HardwareAddr: dbEp.HwAddress,
+		Address:      dbEp.Address,
+		sfNum:        dbEp.SfNum,
+		sfPort:       dbEp.SfPort,
+	}
+	log.Printf("RestoreEndpoint [ %s ] sf: %s\n", id, dbEp.SfPort)
+	return nil
+}
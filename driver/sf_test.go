@@ -0,0 +1,289 @@
+package driver
+
+import (
+	"fmt"
+	"github.com/docker/go-plugins-helpers/network"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSfManager records the subfunction operations and fails the ones
+// listed in fail.
+type fakeSfManager struct {
+	calls []string
+	fail  map[string]bool
+	state map[string]string // by port
+}
+
+func newFakeSfManager() *fakeSfManager {
+	return &fakeSfManager{
+		fail:  make(map[string]bool),
+		state: make(map[string]string),
+	}
+}
+
+func (m *fakeSfManager) record(op string, args ...string) error {
+	m.calls = append(m.calls, strings.Join(append([]string{op}, args...), " "))
+	if m.fail[op] {
+		return fmt.Errorf("%s failed", op)
+	}
+	return nil
+}
+
+func (m *fakeSfManager) AddSf(pciAddr string, pfNum int, sfNum int) (string, error) {
+	port := fmt.Sprintf("pci/%s/%d", pciAddr, 32768+sfNum)
+	err := m.record("add", port)
+	if err != nil {
+		return "", err
+	}
+	m.state[port] = sfStateInactive
+	return port, nil
+}
+
+func (m *fakeSfManager) SetSfHwAddr(port string, hwAddr string) error {
+	return m.record("hw_addr", port, hwAddr)
+}
+
+func (m *fakeSfManager) SetSfRate(port string, txMax string) error {
+	return m.record("rate", port, txMax)
+}
+
+func (m *fakeSfManager) SetSfState(port string, state string) error {
+	err := m.record("state", port, state)
+	if err == nil {
+		m.state[port] = state
+	}
+	return err
+}
+
+func (m *fakeSfManager) GetSfState(port string) (string, error) {
+	state, ok := m.state[port]
+	if !ok {
+		return "", fmt.Errorf("sf port %s not found", port)
+	}
+	return state, nil
+}
+
+func (m *fakeSfManager) DelSf(port string) error {
+	err := m.record("del", port)
+	if err == nil {
+		delete(m.state, port)
+	}
+	return err
+}
+
+const (
+	testSfPciAddr = "0000:03:00.0"
+	testSfPort    = "pci/0000:03:00.0/32769"
+	testSfHwAddr  = "02:00:00:00:00:01"
+)
+
+// setupSfTest installs a fake subfunction manager and netdevice lookup and
+// returns an sf network on them, with a function restoring the real ones.
+func setupSfTest(netdevErr error) (*fakeSfManager, *sfNetwork, func()) {
+	mgr := newFakeSfManager()
+	prevMgr, prevWait := sfMgr, sfNetdevWait
+	sfMgr = mgr
+	sfNetdevWait = func(hwAddr string, timeout time.Duration) (string, error) {
+		if netdevErr != nil {
+			return "", netdevErr
+		}
+		return "enp3s0f0s1", nil
+	}
+	sfNumsInUse = nil
+	restore := func() {
+		sfMgr, sfNetdevWait = prevMgr, prevWait
+		sfNumsInUse = nil
+	}
+
+	nw := &sfNetwork{
+		genNw:   createGenNw("nw1", "enp3s0f0", "sf", "", nil),
+		pciAddr: testSfPciAddr,
+	}
+	return mgr, nw, restore
+}
+
+func sfEndpointRequest() *network.CreateEndpointRequest {
+	return &network.CreateEndpointRequest{
+		NetworkID:  "nw1",
+		EndpointID: "ep1",
+		Interface:  &network.EndpointInterface{MacAddress: testSfHwAddr},
+	}
+}
+
+func checkSfCalls(t *testing.T, mgr *fakeSfManager, expected ...string) {
+	if strings.Join(mgr.calls, "; ") != strings.Join(expected, "; ") {
+		t.Errorf("calls %q, expected %q", mgr.calls, expected)
+	}
+}
+
+func TestSfCreateEndpoint(t *testing.T) {
+	mgr, nw, restore := setupSfTest(nil)
+	defer restore()
+	nw.rate = "1gbit"
+
+	_, err := nw.CreateEndpoint(sfEndpointRequest())
+	if err != nil {
+		t.Fatalf("CreateEndpoint: %v", err)
+	}
+	checkSfCalls(t, mgr,
+		"add "+testSfPort,
+		"hw_addr "+testSfPort+" "+testSfHwAddr,
+		"rate "+testSfPort+" 1gbit",
+		"state "+testSfPort+" "+sfStateActive)
+
+	ep := nw.genNw.ndevEndpoints["ep1"]
+	if ep == nil {
+		t.Fatalf("no endpoint created")
+	}
+	if ep.sfPort != testSfPort || ep.sfNum != 1 || ep.devName != "enp3s0f0s1" {
+		t.Errorf("endpoint port %s sf %d netdev %s", ep.sfPort, ep.sfNum, ep.devName)
+	}
+	if !sfNumsInUse[nw.genNw.ndevName][1] {
+		t.Errorf("sf number 1 not in use")
+	}
+}
+
+func TestSfCreateEndpointNoRate(t *testing.T) {
+	mgr, nw, restore := setupSfTest(nil)
+	defer restore()
+
+	_, err := nw.CreateEndpoint(sfEndpointRequest())
+	if err != nil {
+		t.Fatalf("CreateEndpoint: %v", err)
+	}
+	checkSfCalls(t, mgr,
+		"add "+testSfPort,
+		"hw_addr "+testSfPort+" "+testSfHwAddr,
+		"state "+testSfPort+" "+sfStateActive)
+}
+
+func TestSfCreateEndpointRandomHwAddr(t *testing.T) {
+	_, nw, restore := setupSfTest(nil)
+	defer restore()
+
+	r := sfEndpointRequest()
+	r.Interface.MacAddress = ""
+	resp, err := nw.CreateEndpoint(r)
+	if err != nil {
+		t.Fatalf("CreateEndpoint: %v", err)
+	}
+	if resp.Interface == nil || resp.Interface.MacAddress == "" {
+		t.Fatalf("no mac address returned")
+	}
+	if resp.Interface.MacAddress != nw.genNw.ndevEndpoints["ep1"].HardwareAddr {
+		t.Errorf("returned mac %s, sf has %s", resp.Interface.MacAddress,
+			nw.genNw.ndevEndpoints["ep1"].HardwareAddr)
+	}
+}
+
+func TestSfDeleteEndpoint(t *testing.T) {
+	mgr, nw, restore := setupSfTest(nil)
+	defer restore()
+
+	_, err := nw.CreateEndpoint(sfEndpointRequest())
+	if err != nil {
+		t.Fatalf("CreateEndpoint: %v", err)
+	}
+	mgr.calls = nil
+	nw.DeleteEndpoint(nw.genNw.ndevEndpoints["ep1"])
+
+	checkSfCalls(t, mgr,
+		"state "+testSfPort+" "+sfStateInactive,
+		"del "+testSfPort)
+	if sfNumsInUse[nw.genNw.ndevName][1] {
+		t.Errorf("sf number 1 still in use")
+	}
+}
+
+func TestSfCreateEndpointRollback(t *testing.T) {
+	for _, op := range []string{"hw_addr", "rate", "state"} {
+		mgr, nw, restore := setupSfTest(nil)
+		nw.rate = "1gbit"
+		mgr.fail[op] = true
+
+		_, err := nw.CreateEndpoint(sfEndpointRequest())
+		if err == nil {
+			restore()
+			t.Fatalf("CreateEndpoint succeeded with failing %s", op)
+		}
+		last := mgr.calls[len(mgr.calls)-1]
+		if last != "del "+testSfPort {
+			t.Errorf("%s failure: last call %q, expected the sf deleted", op, last)
+		}
+		for _, call := range mgr.calls {
+			if call == "state "+testSfPort+" "+sfStateInactive {
+				t.Errorf("%s failure: inactive sf deactivated", op)
+			}
+		}
+		if len(mgr.state) != 0 {
+			t.Errorf("%s failure: sf ports left %v", op, mgr.state)
+		}
+		if len(nw.genNw.ndevEndpoints) != 0 || sfNumsInUse[nw.genNw.ndevName][1] {
+			t.Errorf("%s failure: endpoint or sf number left", op)
+		}
+		restore()
+	}
+}
+
+func TestSfCreateEndpointAddFailure(t *testing.T) {
+	mgr, nw, restore := setupSfTest(nil)
+	defer restore()
+	mgr.fail["add"] = true
+
+	_, err := nw.CreateEndpoint(sfEndpointRequest())
+	if err == nil {
+		t.Fatalf("CreateEndpoint succeeded with failing add")
+	}
+	checkSfCalls(t, mgr, "add "+testSfPort)
+	if sfNumsInUse[nw.genNw.ndevName][1] {
+		t.Errorf("sf number 1 still in use")
+	}
+}
+
+func TestSfCreateEndpointNoNetdev(t *testing.T) {
+	mgr, nw, restore := setupSfTest(fmt.Errorf("not found"))
+	defer restore()
+
+	_, err := nw.CreateEndpoint(sfEndpointRequest())
+	if err == nil {
+		t.Fatalf("CreateEndpoint succeeded without sf netdevice")
+	}
+	calls := mgr.calls[len(mgr.calls)-2:]
+	if calls[0] != "state "+testSfPort+" "+sfStateInactive || calls[1] != "del "+testSfPort {
+		t.Errorf("last calls %q, expected the sf deactivated and deleted", calls)
+	}
+	if len(nw.genNw.ndevEndpoints) != 0 || sfNumsInUse[nw.genNw.ndevName][1] {
+		t.Errorf("endpoint or sf number left")
+	}
+}
+
+func TestSfRestoreEndpoint(t *testing.T) {
+	mgr, nw, restore := setupSfTest(nil)
+	defer restore()
+	mgr.state[testSfPort] = sfStateActive
+
+	dbEp := &DB_Endpoint{
+		DevName:   "enp3s0f0s1",
+		HwAddress: testSfHwAddr,
+		SfNum:     1,
+		SfPort:    testSfPort,
+	}
+	err := nw.RestoreEndpoint("ep1", dbEp)
+	if err != nil {
+		t.Fatalf("RestoreEndpoint: %v", err)
+	}
+	if nw.genNw.ndevEndpoints["ep1"] == nil || !sfNumsInUse[nw.genNw.ndevName][1] {
+		t.Errorf("endpoint not restored")
+	}
+
+	mgr.state[testSfPort] = sfStateInactive
+	err = nw.RestoreEndpoint("ep2", dbEp)
+	if err == nil {
+		t.Fatalf("RestoreEndpoint succeeded on an inactive sf")
+	}
+	if _, ok := mgr.state[testSfPort]; ok {
+		t.Errorf("inactive sf not deleted")
+	}
+}
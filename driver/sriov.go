@@ -18,13 +18,24 @@ type pfDevice struct {
 	pfHandle      *sriovnet.PfNetdevHandle
 	state         string
 	nwUseRefCount int
+	cfg           *Daemon_Pf_Config // current PF settings
+	prevCfg       *Daemon_Pf_Config // PF settings to restore, if changed
+	denied        map[int]bool      // VFs on the deny list, never allocated
 }
 
 type sriovNetwork struct {
-	genNw        *genericNetwork
-	vlan         int
-	privileged   int
-	roceHopLimit uint8
+	genNw       *genericNetwork
+	vlan        int
+	privileged  int
+	eswitchMode string
+	bridge      string
+	bridgeType  string
+	acl         []aclRule
+	ib          bool      // InfiniBand PF, VFs are given GUIDs
+	guidPool    *guidPool // nil to derive GUIDs from endpoint ids
+	pkey        uint16    // InfiniBand partition of the network, 0 for default
+	allocator   vfAllocator
+	partition   *vfPartition
 }
 
 // nid to network map
@@ -77,17 +88,72 @@ func (nw *sriovNetwork) CreateNetwork(d *driver, genNw *genericNetwork,
 	}
 	nw.privileged = privileged
 
-	if options[roceHopLimit] != "" {
-		var err1 error
-		var value int
-		value, err1 = strconv.Atoi(options[roceHopLimit])
-		if err1 != nil {
-			return fmt.Errorf("Invalid roceHopLimit: ", err1)
+	nw.allocator, err = newVfAllocator(options[networkVfPolicy])
+	if err != nil {
+		return err
+	}
+	nw.partition, err = parseVfPartition(options)
+	if err != nil {
+		return err
+	}
+
+	pfCfg, err := pfConfigFromOptions(d.config.pfConfig(ndevName), options)
+	if err != nil {
+		return err
+	}
+
+	nw.bridge = options[networkBridge]
+	nw.bridgeType = options[networkBridgeType]
+	if nw.bridgeType == "" {
+		nw.bridgeType = bridgeTypeLinux
+	}
+	if nw.bridgeType != bridgeTypeLinux && nw.bridgeType != bridgeTypeOVS {
+		return fmt.Errorf("valid bridge types are: linux and ovs")
+	}
+	if pfCfg.Eswitch == eswitchModeSwitchdev && nw.bridge == "" {
+		return fmt.Errorf("switchdev mode requires bridge")
+	}
+	if nw.bridge != "" && nw.bridgeType == bridgeTypeLinux && vlan > 0 {
+		filtering, err := bridgeVlanFiltering(nw.bridge)
+		if err != nil {
+			return err
 		}
-		if value < 0 || value > 255 {
-			return fmt.Errorf("Valid range of rocehoplimit is: [0..255]")
+		if !filtering {
+			return fmt.Errorf("vlan requires vlan_filtering enabled on bridge %s", nw.bridge)
+		}
+	}
+
+	if options[networkAcl] != "" {
+		nw.acl, err = parseAcl(options[networkAcl])
+		if err != nil {
+			return err
+		}
+	}
+
+	nw.ib = isIBNetdev(ndevName)
+	if options[networkGuidPool] != "" {
+		if !nw.ib {
+			return fmt.Errorf("guid_pool requires an InfiniBand device")
+		}
+		nw.guidPool, err = parseGuidPool(options[networkGuidPool])
+		if err != nil {
+			return err
+		}
+		if checkGuidPoolNwExist(ndevName, nw.guidPool) {
+			return fmt.Errorf("guid_pool overlaps the guid_pool of another network of %s", ndevName)
+		}
+	}
+	if options[networkPkey] != "" {
+		if !nw.ib {
+			return fmt.Errorf("pkey requires an InfiniBand device")
+		}
+		nw.pkey, err = parsePkey(options[networkPkey])
+		if err != nil {
+			return err
+		}
+		if checkPkeyNwExist(ndevName, nw.pkey) {
+			return fmt.Errorf("pkey already exist")
 		}
-		nw.roceHopLimit = uint8(value)
 	}
 
 	nw.genNw = genNw
@@ -97,8 +163,34 @@ func (nw *sriovNetwork) CreateNetwork(d *driver, genNw *genericNetwork,
 		return fmt.Errorf("Fail to set PF link up: ", err)
 	}
 
-	err = nw.DiscoverVFs(ndevName)
+	deny, err := d.config.vfDenyList(ndevName)
+	if err != nil {
+		return err
+	}
+
+	err = nw.DiscoverVFs(ndevName, pfCfg, deny)
+	if err != nil {
+		return err
+	}
+
+	// eswitch mode is a property of the PF, which may have been
+	// configured by another network or outside of the plugin.
+	dev := pfDevices[ndevName]
+	nw.eswitchMode = dev.cfg.Eswitch
+	if nw.eswitchMode == "" {
+		nw.eswitchMode = eswitchModeLegacy
+	}
+	if nw.eswitchMode == eswitchModeSwitchdev && nw.bridge == "" {
+		err = fmt.Errorf("switchdev mode requires bridge")
+	} else if len(nw.acl) > 0 && nw.eswitchMode != eswitchModeSwitchdev {
+		err = fmt.Errorf("acl requires switchdev eswitch mode")
+	} else {
+		err = nw.checkVfPartition(dev)
+	}
 	if err != nil {
+		if dev.nwUseRefCount == 0 {
+			releasePfDevice(ndevName)
+		}
 		return err
 	}
 	// store vlan so that when VFs are attached to container, vlan will be set at that time
@@ -109,7 +201,6 @@ func (nw *sriovNetwork) CreateNetwork(d *driver, genNw *genericNetwork,
 
 	networks[nid] = nw
 
-	dev := pfDevices[ndevName]
 	dev.nwUseRefCount++
 	log.Printf("SRIOV CreateNetwork : [%s] IPv4Data : [ %+v ]\n", nw.genNw.id, nw.genNw.IPv4Data)
 	return nil
@@ -117,19 +208,90 @@ func (nw *sriovNetwork) CreateNetwork(d *driver, genNw *genericNetwork,
 
 func disableSRIOV(pfNetdevName string) {
 
-	sriovnet.DisableSriov(pfNetdevName)
 	dev := pfDevices[pfNetdevName]
+	// Disabling SRIOV destroys all VFs, including denied VFs used
+	// outside of the plugin.
+	if len(dev.denied) > 0 {
+		log.Printf("SRIOV of %s is kept enabled for denied vfs %v\n",
+			pfNetdevName, sortedVfIndices(dev.denied))
+		return
+	}
+	sriovnet.DisableSriov(pfNetdevName)
 	dev.state = SRIOV_DISABLED
 }
 
-func initSriovState(pfNetdevName string, dev *pfDevice) error {
+// applyPfDeviceConfig applies the PF settings and remembers the settings
+// to restore. Settings saved before a plugin restart take precedence
+// over the current ones, which were configured by the plugin itself.
+func applyPfDeviceConfig(pfNetdevName string, dev *pfDevice, cfg *Daemon_Pf_Config) error {
+
+	saved, _ := Read_Pf_Config_From_DB(pfNetdevName)
+
+	prev, err := applyPfConfig(pfNetdevName, cfg)
+	if err != nil {
+		return err
+	}
+	if saved != nil {
+		prev = saved
+	} else {
+		err = Write_Pf_Config_to_DB(pfNetdevName, prev)
+		if err != nil {
+			restorePfConfig(pfNetdevName, prev)
+			return err
+		}
+	}
+	dev.prevCfg = prev
+	return nil
+}
+
+// revertPfDeviceConfig restores the PF settings found before
+// applyPfDeviceConfig, when the PF can't be used after all.
+func revertPfDeviceConfig(pfNetdevName string, dev *pfDevice) {
+	if dev.prevCfg == nil {
+		return
+	}
+	err := restorePfConfig(pfNetdevName, dev.prevCfg)
+	if err != nil {
+		log.Printf("Fail to restore PF config of %s: %v\n", pfNetdevName, err)
+		return
+	}
+	Del_Pf_Config_From_DB(pfNetdevName)
+	dev.prevCfg = nil
+}
+
+func initSriovState(pfNetdevName string, dev *pfDevice, cfg *Daemon_Pf_Config, deny *vfDenyList) error {
 	var err error
 
 	enabled := sriovnet.IsSriovEnabled(pfNetdevName)
+	if enabled && !cfg.isEmpty() && len(deny.deniedVfs(pfNetdevName)) > 0 {
+		// changing the VF count recreates all VFs, and changing the
+		// eswitch unbinds them, denied VFs are used outside the plugin
+		cur, err := readPfConfig(pfNetdevName)
+		if err != nil {
+			return err
+		}
+		if cfg.NumVfs != 0 && cfg.NumVfs != cur.NumVfs {
+			return fmt.Errorf("numvfs of %s can't change, it has denied vfs", pfNetdevName)
+		}
+		if cfg.eswitchChanges(cur) {
+			return fmt.Errorf("eswitch settings of %s can't change, it has denied vfs", pfNetdevName)
+		}
+	}
 
-	if !enabled {
+	if !cfg.isEmpty() {
+		err = applyPfDeviceConfig(pfNetdevName, dev, cfg)
+		if err != nil {
+			return err
+		}
+		if cfg.NumVfs != 0 && cfg.NumVfs != dev.prevCfg.NumVfs {
+			enabled = false
+		}
+	}
+
+	if !sriovnet.IsSriovEnabled(pfNetdevName) {
 		err = sriovnet.EnableSriov(pfNetdevName)
 		if err != nil {
+			revertPfDeviceConfig(pfNetdevName, dev)
 			return fmt.Errorf("Fail to enable sriov: %v", err)
 		}
 		log.Println("Enabled sriov on netdevice: ", pfNetdevName)
@@ -138,23 +300,123 @@ func initSriovState(pfNetdevName string, dev *pfDevice) error {
 	dev.pfHandle, err = sriovnet.GetPfNetdevHandle(pfNetdevName)
 	if err != nil {
 		log.Println("fail to get handle: ", pfNetdevName, err)
+		revertPfDeviceConfig(pfNetdevName, dev)
 		return fmt.Errorf("Fail to get device handle: %v", err)
 	}
+	dev.denied = deny.deniedVfs(pfNetdevName)
+	if len(dev.denied) > 0 {
+		reserveDeniedVfs(dev)
+		log.Printf("Denied vfs of %s: %v\n", pfNetdevName, sortedVfIndices(dev.denied))
+	}
 
 	if !enabled {
 		log.Println("Configuring sriov devices: ", pfNetdevName)
 		err = sriovnet.ConfigVfs(dev.pfHandle, true)
 		if err != nil {
+			revertPfDeviceConfig(pfNetdevName, dev)
 			return fmt.Errorf("Fail to configure vfs: %v", err)
 		}
 		log.Println("Configuring sriov devices done: ", pfNetdevName)
 	}
 
+	dev.cfg, err = readPfConfig(pfNetdevName)
+	if err != nil {
+		dev.cfg = &Daemon_Pf_Config{}
+	}
 	dev.state = SRIOV_ENABLED
 	return nil
 }
 
-func (nw *sriovNetwork) DiscoverVFs(pfNetdevName string) error {
+// releasePfDevice disables SRIOV, or restores the previous PF settings,
+// once the last network of the PF is gone.
+func releasePfDevice(pfNetdevName string) {
+
+	dev := pfDevices[pfNetdevName]
+	if dev.prevCfg != nil && len(dev.denied) > 0 {
+		// saved settings are restored once no VF is denied
+		log.Printf("PF config of %s is kept for denied vfs %v\n",
+			pfNetdevName, sortedVfIndices(dev.denied))
+	} else if dev.prevCfg != nil {
+		err := restorePfConfig(pfNetdevName, dev.prevCfg)
+		if err != nil {
+			log.Printf("Fail to restore PF config of %s: %v\n", pfNetdevName, err)
+		}
+		Del_Pf_Config_From_DB(pfNetdevName)
+		dev.state = SRIOV_DISABLED
+	} else {
+		disableSRIOV(pfNetdevName)
+	}
+	delete(pfDevices, pfNetdevName)
+}
+
+// restoreDeferredPfConfigs restores the saved settings of PFs which no
+// network uses, and which were kept configured for their denied VFs.
+func restoreDeferredPfConfigs(config *Daemon_Config) {
+	pfNetdevNames, err := Read_Pf_Config_List_From_DB()
+	if err != nil {
+		return
+	}
+	for _, pfNetdevName := range pfNetdevNames {
+		if pfDevices[pfNetdevName] != nil {
+			continue
+		}
+		deny, err := config.vfDenyList(pfNetdevName)
+		if err != nil {
+			continue
+		}
+		denied := deny.deniedVfs(pfNetdevName)
+		if len(denied) > 0 {
+			log.Printf("PF config of %s is kept for denied vfs %v\n",
+				pfNetdevName, sortedVfIndices(denied))
+			continue
+		}
+		prev, err := Read_Pf_Config_From_DB(pfNetdevName)
+		if err != nil {
+			continue
+		}
+		err = restorePfConfig(pfNetdevName, prev)
+		if err != nil {
+			log.Printf("Fail to restore PF config of %s: %v\n", pfNetdevName, err)
+			continue
+		}
+		Del_Pf_Config_From_DB(pfNetdevName)
+	}
+}
+
+// allocateVfByIndex allocates the VF with the given index of the PF.
+func allocateVfByIndex(handle *sriovnet.PfNetdevHandle, index int) (*sriovnet.VfObj, error) {
+	for _, vf := range handle.List {
+		if vf.Index != index {
+			continue
+		}
+		if vf.Allocated {
+			return nil, fmt.Errorf("vf %d of %v is already allocated", index, handle.PfNetdevName)
+		}
+		vf.Allocated = true
+		return vf, nil
+	}
+	return nil, fmt.Errorf("vf %d not found on %v", index, handle.PfNetdevName)
+}
+
+// allocateVf allocates the free VF of the PF chosen by the VF policy of
+// the network, among the ones on the NUMA nodes of the container if any.
+func (nw *sriovNetwork) allocateVf(dev *pfDevice) (*sriovnet.VfObj, error) {
+	free, err := nw.freePoolVfs(dev)
+	if err != nil {
+		return nil, err
+	}
+	pciAddrs := make(map[int]string)
+	for _, vf := range dev.pfHandle.List {
+		pciAddrs[vf.Index] = vf.PciAddress
+	}
+	free, err = numaLocalVfs(free, pciAddrs, nw.genNw.numaNodes, nw.genNw.numaPolicy)
+	if err != nil {
+		return nil, err
+	}
+	return allocateVfByIndex(dev.pfHandle, free[nw.allocator.pick(nw.genNw.ndevName, free)])
+}
+
+func (nw *sriovNetwork) DiscoverVFs(pfNetdevName string, cfg *Daemon_Pf_Config, deny *vfDenyList) error {
 	var err error
 
 	if len(pfDevices) == 0 {
@@ -164,12 +426,17 @@ func (nw *sriovNetwork) DiscoverVFs(pfNetdevName string) error {
 	dev := pfDevices[pfNetdevName]
 	if dev == nil {
 		newDev := pfDevice{}
-		err = initSriovState(pfNetdevName, &newDev)
+		err = initSriovState(pfNetdevName, &newDev, cfg, deny)
 		if err != nil {
 			return err
 		}
 		pfDevices[pfNetdevName] = &newDev
 		dev = &newDev
+	} else {
+		err = checkPfConfigConflict(pfNetdevName, cfg, dev.cfg)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -190,40 +457,101 @@ func (nw *sriovNetwork) CreateEndpoint(r *network.CreateEndpointRequest) (*netwo
 		return nil, fmt.Errorf("Invalid SRIOV configuration")
 	}
 
+	binding := nw.genNw.driver.ipam.lookupBinding(nw.genNw.ndevName,
+		nw.genNw.IPv4Data.Pool, r.Interface.Address)
+
 	if r.Interface.MacAddress != "" {
 		vfObj, err = sriovnet.AllocateVfByMacAddress(dev.pfHandle, r.Interface.MacAddress)
-	} else {
-		vfObj, err = sriovnet.AllocateVf(dev.pfHandle)
+	} else if binding != nil && binding.VfIndex >= 0 {
+		vfObj, err = allocateVfByIndex(dev.pfHandle, binding.VfIndex)
+	} else if binding != nil && binding.HwAddress != "" {
+		vfObj, err = sriovnet.AllocateVfByMacAddress(dev.pfHandle, binding.HwAddress)
+	}
+	if vfObj == nil && (binding == nil || !binding.Static) && r.Interface.MacAddress == "" {
+		vfObj, err = nw.allocateVf(dev)
 	}
 
 	if err != nil {
 		return nil, fmt.Errorf("Fail to allocate VF err = %v", err)
 	}
+	if vfObj != nil && !nw.inVfPool(vfObj.Index) {
+		sriovnet.FreeVf(dev.pfHandle, vfObj)
+		return nil, fmt.Errorf("vf %d is not among the VFs of the network", vfObj.Index)
+	}
+
+	var vfRepName string
+	if nw.eswitchMode == eswitchModeSwitchdev {
+		// vlan and spoof check are policies of the representor port in
+		// switchdev mode instead of VF settings.
+		vfRepName, err = GetVfRepresentor(nw.genNw.ndevName, vfObj.Index)
+		if err == nil {
+			err = applyAcl(vfRepName, nw.acl)
+		}
+		if err != nil {
+			sriovnet.FreeVf(dev.pfHandle, vfObj)
+			return nil, fmt.Errorf("Fail to apply acl err = %v", err)
+		}
+		err = AttachVfRepresentor(vfRepName, nw.bridge, nw.bridgeType, nw.vlan)
+		if err != nil {
+			removeAcl(vfRepName, len(nw.acl))
+			sriovnet.FreeVf(dev.pfHandle, vfObj)
+			return nil, fmt.Errorf("Fail to attach vf representor err = %v", err)
+		}
+	} else {
+		if nw.vlan > 0 {
+			sriovnet.SetVfVlan(dev.pfHandle, vfObj, nw.vlan)
+		}
 
-	if nw.vlan > 0 {
-		sriovnet.SetVfVlan(dev.pfHandle, vfObj, nw.vlan)
+		err2 := sriovnet.SetVfPrivileged(dev.pfHandle, vfObj, privileged)
+		if err2 != nil {
+			sriovnet.FreeVf(dev.pfHandle, vfObj)
+			return nil, fmt.Errorf("Fail to set priviledged err = %v", err2)
+		}
 	}
 
-	err2 := sriovnet.SetVfPrivileged(dev.pfHandle, vfObj, privileged)
-	if err2 != nil {
-		sriovnet.FreeVf(dev.pfHandle, vfObj)
-		return nil, fmt.Errorf("Fail to set priviledged err = %v", err2)
+	ndev := &ptEndpoint{
+		devName:   sriovnet.GetVfNetdevName(dev.pfHandle, vfObj),
+		vfObj:     vfObj,
+		vfRepName: vfRepName,
+		Address:   r.Interface.Address,
 	}
 
-	if nw.roceHopLimit != 0 {
-		err = setRoceHopLimitWA(sriovnet.GetVfNetdevName(dev.pfHandle, vfObj), nw.roceHopLimit)
+	if nw.pkey != 0 {
+		ndev.pkeyState, err = applyVfPkey(nw.genNw.ndevName, vfObj.PciAddress, nw.pkey)
+		if err != nil {
+			nw.DeleteEndpoint(ndev)
+			return nil, fmt.Errorf("Fail to set pkey err = %v", err)
+		}
+	}
+	if nw.ib {
+		ndev.guid, err = nw.allocGuid(r.EndpointID)
 		if err != nil {
-			return nil, fmt.Errorf("Fail to set RoCE Hoplimit = %v", err)
+			nw.DeleteEndpoint(ndev)
+			return nil, err
 		}
+		err = assignVfGuid(nw.genNw.ndevName, vfObj.Index, vfObj.PciAddress, ndev.guid)
+		if err != nil {
+			nw.DeleteEndpoint(ndev)
+			return nil, fmt.Errorf("Fail to assign guid err = %v", err)
+		}
+		// VF netdevice is recreated by the driver rebind
+		ndev.devName = sriovnet.GetVfNetdevName(dev.pfHandle, vfObj)
+	}
+
+	ndev.rdmaState, err = nw.genNw.rdmaTuning.apply(ndev.devName)
+	if err != nil {
+		nw.DeleteEndpoint(ndev)
+		return nil, fmt.Errorf("Fail to apply rdma settings: %v", err)
 	}
 
 	log.Printf("AllocVF PF [ %+v ] vf:%v\n", nw.genNw.ndevName, vfObj)
 
-	ndev := &ptEndpoint{
-		devName: sriovnet.GetVfNetdevName(dev.pfHandle, vfObj),
-		vfObj:   vfObj,
-		Address: r.Interface.Address,
+	if binding == nil || !binding.Static {
+		hwAddr, _ := GetVFDefaultMacAddr(sriovnet.GetVfNetdevName(dev.pfHandle, vfObj))
+		nw.genNw.driver.ipam.learnBinding(nw.genNw.ndevName, nw.genNw.IPv4Data.Pool,
+			r.Interface.Address, vfObj.Index, hwAddr)
 	}
+
 	nw.genNw.ndevEndpoints[r.EndpointID] = ndev
 
 	endpointInterface := &network.EndpointInterface{}
@@ -242,7 +570,81 @@ func (nw *sriovNetwork) CreateEndpoint(r *network.CreateEndpointRequest) (*netwo
 func (nw *sriovNetwork) DeleteEndpoint(endpoint *ptEndpoint) {
 
 	dev := pfDevices[nw.genNw.ndevName]
+	endpoint.rdmaState.revert()
+	endpoint.pkeyState.revert()
+	if endpoint.guid != 0 {
+		err := setVfGuid(nw.genNw.ndevName, endpoint.vfObj.Index, 0)
+		if err != nil {
+			log.Printf("Fail to clear guid of vf %d: %v\n", endpoint.vfObj.Index, err)
+		}
+		nw.freeGuid(endpoint.guid)
+	}
+	if endpoint.vfRepName != "" {
+		err := DetachVfRepresentor(endpoint.vfRepName, nw.bridge, nw.bridgeType)
+		if err != nil {
+			log.Printf("Fail to detach vf representor %s: %v\n", endpoint.vfRepName, err)
+		}
+		if len(nw.acl) > 0 {
+			removeAcl(endpoint.vfRepName, len(nw.acl))
+		}
+	}
 	sriovnet.FreeVf(dev.pfHandle, endpoint.vfObj)
+	recordVfRelease(nw.genNw.ndevName, endpoint.vfObj.Index)
+}
+
+// RestoreEndpoint takes over an endpoint created before the plugin
+// restarted and reapplies its ACL.
+func (nw *sriovNetwork) RestoreEndpoint(id string, dbEp *DB_Endpoint) error {
+
+	dev := pfDevices[nw.genNw.ndevName]
+	if dev == nil || dev.pfHandle == nil {
+		return fmt.Errorf("Invalid SRIOV configuration")
+	}
+
+	vfObj, err := allocateVfByIndex(dev.pfHandle, dbEp.VfIndex)
+	if err != nil {
+		return err
+	}
+	nw.allocator.restore(nw.genNw.ndevName, dbEp.VfIndex)
+
+	if dbEp.VfRepName != "" && len(nw.acl) > 0 {
+		err = applyAcl(dbEp.VfRepName, nw.acl)
+		if err != nil {
+			sriovnet.FreeVf(dev.pfHandle, vfObj)
+			return err
+		}
+	}
+
+	endpoint := &ptEndpoint{
+		devName:   dbEp.DevName,
+		vfObj:     vfObj,
+		vfRepName: dbEp.VfRepName,
+		Address:   dbEp.Address,
+		pkeyState: rdmaStateFromDb(dbEp.PkeyState),
+		rdmaState: rdmaStateFromDb(dbEp.RdmaState),
+	}
+	if dbEp.Guid != "" {
+		endpoint.guid, err = parseGuid(dbEp.Guid)
+		if err == nil && nw.guidPool != nil {
+			nw.guidPool.reserve(endpoint.guid)
+		}
+	}
+	nw.genNw.ndevEndpoints[id] = endpoint
+	log.Printf("RestoreEndpoint [ %s ] vf: %d\n", id, dbEp.VfIndex)
+	return nil
+}
+
+func (nw *sriovNetwork) allocGuid(endpointID string) (uint64, error) {
+	if nw.guidPool != nil {
+		return nw.guidPool.alloc()
+	}
+	return guidFromEndpoint(endpointID), nil
+}
+
+func (nw *sriovNetwork) freeGuid(guid uint64) {
+	if nw.guidPool != nil {
+		nw.guidPool.free(guid)
+	}
 }
 
 func (nw *sriovNetwork) DeleteNetwork(d *driver, req *network.DeleteNetworkRequest) {
@@ -254,8 +656,7 @@ func (nw *sriovNetwork) DeleteNetwork(d *driver, req *network.DeleteNetworkReque
 	// So first created network enables SRIOV and
 	// Last network that gets deleted, disables SRIOV.
 	if dev.nwUseRefCount == 0 {
-		disableSRIOV(nw.genNw.ndevName)
-		delete(pfDevices, nw.genNw.ndevName)
+		releasePfDevice(nw.genNw.ndevName)
 	}
 	delete(networks, nw.genNw.id)
 	log.Printf("DeleteNetwork: total networks = %d\n", len(networks))
@@ -291,3 +291,17 @@ func FindVFDirForNetdev(pfNetdevName string, vfNetdevName string) (string, error
 	}
 	return "", fmt.Errorf("device %s not found", vfNetdevName)
 }
+
+func findLinkByHwAddr(hwAddr string) (netlink.Link, error) {
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		if link.Attrs().HardwareAddr.String() == hwAddr {
+			return link, nil
+		}
+	}
+	return nil, fmt.Errorf("device with address %s not found", hwAddr)
+}
@@ -0,0 +1,173 @@
+package driver
+
+import (
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	netdevPhysSwitchIDFile = "phys_switch_id"
+	netdevPhysPortNameFile = "phys_port_name"
+
+	bridgeVlanFilteringFile = "bridge/vlan_filtering"
+	bridgeDefaultPvidFile   = "bridge/default_pvid"
+)
+
+func runCommand(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %v %s", name,
+			strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func netdevReadAttr(netdevName string, attr string) string {
+	attrFile := fileObject{
+		Path: filepath.Join(netSysDir, netdevName, attr),
+	}
+
+	value, err := attrFile.Read()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(value)
+}
+
+// isVfRepPortName checks whether the physical port name of a representor,
+// either "pfNvfM" or plain "M" on older kernels, belongs to the VF of the
+// PF numbered pfNum. PFs of a NIC may share the switch of their
+// representors.
+func isVfRepPortName(portName string, pfNum int, vfIndex int) bool {
+	if strings.HasPrefix(portName, "pf") {
+		return portName == fmt.Sprintf("pf%dvf%d", pfNum, vfIndex)
+	}
+	return portName == strconv.Itoa(vfIndex)
+}
+
+// GetVfRepresentor returns the representor netdevice of a VF of a PF
+// whose eswitch is in switchdev mode.
+func GetVfRepresentor(pfNetdevName string, vfIndex int) (string, error) {
+
+	switchID := netdevReadAttr(pfNetdevName, netdevPhysSwitchIDFile)
+	if switchID == "" {
+		return "", fmt.Errorf("%s is not in switchdev mode", pfNetdevName)
+	}
+	pciAddr, err := netdevPciAddress(pfNetdevName)
+	if err != nil {
+		return "", err
+	}
+	pfNum, err := pciFunctionNumber(pciAddr)
+	if err != nil {
+		return "", err
+	}
+
+	netdevs, err := lsDirs(netSysDir)
+	if err != nil {
+		return "", err
+	}
+	for _, netdev := range netdevs {
+		if netdev == pfNetdevName {
+			continue
+		}
+		if netdevReadAttr(netdev, netdevPhysSwitchIDFile) != switchID {
+			continue
+		}
+		if isVfRepPortName(netdevReadAttr(netdev, netdevPhysPortNameFile), pfNum, vfIndex) {
+			return netdev, nil
+		}
+	}
+	return "", fmt.Errorf("representor of vf %d of %s not found", vfIndex, pfNetdevName)
+}
+
+// bridgeVlanFiltering tells whether vlan filtering is enabled on a
+// Linux bridge; without it the vlan of the bridge ports is ignored.
+func bridgeVlanFiltering(bridge string) (bool, error) {
+	attrFile := fileObject{
+		Path: filepath.Join(netSysDir, bridge, bridgeVlanFilteringFile),
+	}
+	value, err := attrFile.ReadInt()
+	if err != nil {
+		return false, fmt.Errorf("Fail to read vlan filtering of bridge %s: %v", bridge, err)
+	}
+	return value == 1, nil
+}
+
+// removeBridgeDefaultPvid removes the default vlan, which the bridge adds
+// as pvid of every new port, so that the port only carries the vlan of
+// the network.
+func removeBridgeDefaultPvid(repName string, bridge string, vlan int) error {
+	attrFile := fileObject{
+		Path: filepath.Join(netSysDir, bridge, bridgeDefaultPvidFile),
+	}
+	pvid, err := attrFile.ReadInt()
+	if err != nil {
+		pvid = 1
+	}
+	if pvid == 0 || pvid == vlan {
+		return nil
+	}
+	return runCommand("bridge", "vlan", "del", "dev", repName,
+		"vid", strconv.Itoa(pvid), "master")
+}
+
+// AttachVfRepresentor adds the VF representor as port of a Linux or OVS
+// bridge and tags the port with the vlan of the network.
+func AttachVfRepresentor(repName string, bridge string, bridgeType string, vlan int) error {
+
+	repHandle, err := netlink.LinkByName(repName)
+	if err != nil {
+		return err
+	}
+
+	if bridgeType == bridgeTypeOVS {
+		args := []string{"--may-exist", "add-port", bridge, repName}
+		if vlan > 0 {
+			args = append(args, "tag="+strconv.Itoa(vlan))
+		}
+		err = runCommand("ovs-vsctl", args...)
+		if err != nil {
+			return err
+		}
+	} else {
+		brHandle, err2 := netlink.LinkByName(bridge)
+		if err2 != nil {
+			return fmt.Errorf("Fail to find bridge %s: %v", bridge, err2)
+		}
+		err = netlink.LinkSetMasterByIndex(repHandle, brHandle.Attrs().Index)
+		if err != nil {
+			return err
+		}
+		if vlan > 0 {
+			err = runCommand("bridge", "vlan", "add", "dev", repName,
+				"vid", strconv.Itoa(vlan), "pvid", "untagged", "master")
+			if err == nil {
+				err = removeBridgeDefaultPvid(repName, bridge, vlan)
+			}
+			if err != nil {
+				netlink.LinkSetNoMaster(repHandle)
+				return err
+			}
+		}
+	}
+	return netlink.LinkSetUp(repHandle)
+}
+
+// DetachVfRepresentor removes the VF representor from its bridge.
+func DetachVfRepresentor(repName string, bridge string, bridgeType string) error {
+
+	if bridgeType == bridgeTypeOVS {
+		return runCommand("ovs-vsctl", "--if-exists", "del-port", bridge, repName)
+	}
+
+	repHandle, err := netlink.LinkByName(repName)
+	if err != nil {
+		return err
+	}
+	netlink.LinkSetDown(repHandle)
+	return netlink.LinkSetNoMaster(repHandle)
+}
@@ -0,0 +1,181 @@
+package driver
+
+import (
+	"fmt"
+	"github.com/docker/go-plugins-helpers/network"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	vdpaBusDir         = "/sys/bus/vdpa"
+	vdpaDevicesDir     = "/sys/bus/vdpa/devices"
+	vdpaDriversDir     = "/sys/bus/vdpa/drivers"
+	vdpaVirtioDriver   = "virtio_vdpa"
+	vdpaNetdevWaitTime = 10 * time.Second
+)
+
+// vdpaNetwork hands containers virtio-net netdevices of vdpa devices
+// created on VFs of the PF.
+type vdpaNetwork struct {
+	sriovNetwork
+}
+
+func vdpaDevName(endpointID string) string {
+	if len(endpointID) > 12 {
+		endpointID = endpointID[:12]
+	}
+	return "vdpa-" + endpointID
+}
+
+func vdpaDevDriver(vdpaName string) string {
+	driverLink, err := os.Readlink(filepath.Join(vdpaDevicesDir, vdpaName, "driver"))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(driverLink)
+}
+
+// bindVdpaToVirtio binds a vdpa device to virtio_vdpa driver, which
+// creates a virtio-net netdevice for it in the kernel.
+func bindVdpaToVirtio(vdpaName string) error {
+	curDriver := vdpaDevDriver(vdpaName)
+	if curDriver == vdpaVirtioDriver {
+		return nil
+	}
+
+	if !dirExists(filepath.Join(vdpaDriversDir, vdpaVirtioDriver)) {
+		err := runCommand("modprobe", vdpaVirtioDriver)
+		if err != nil {
+			return err
+		}
+	}
+
+	if curDriver != "" {
+		unbindFile := fileObject{
+			Path: filepath.Join(vdpaDriversDir, curDriver, netdevUnbindFile),
+		}
+		err := unbindFile.Write(vdpaName)
+		if err != nil {
+			return err
+		}
+	}
+	bindFile := fileObject{
+		Path: filepath.Join(vdpaDriversDir, vdpaVirtioDriver, netdevBindFile),
+	}
+	return bindFile.Write(vdpaName)
+}
+
+func waitForVdpaNetdev(vdpaName string, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	pattern := filepath.Join(vdpaDevicesDir, vdpaName, "virtio*", "net", "*")
+
+	for {
+		netDirs, _ := filepath.Glob(pattern)
+		if len(netDirs) != 0 {
+			return filepath.Base(netDirs[0]), nil
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("no virtio netdevice for %s", vdpaName)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// createVdpaDev creates a vdpa device on the VF with the vdpa tool of
+// iproute2 and returns its virtio-net netdevice.
+func createVdpaDev(vdpaName string, vfPciAddr string, hwAddr string) (string, error) {
+	args := []string{"dev", "add", "name", vdpaName, "mgmtdev", "pci/" + vfPciAddr}
+	if hwAddr != "" {
+		args = append(args, "mac", hwAddr)
+	}
+	err := runCommand("vdpa", args...)
+	if err != nil {
+		return "", err
+	}
+
+	err = bindVdpaToVirtio(vdpaName)
+	if err != nil {
+		deleteVdpaDev(vdpaName)
+		return "", fmt.Errorf("Fail to bind %s to %s: %v", vdpaName, vdpaVirtioDriver, err)
+	}
+
+	netdevName, err := waitForVdpaNetdev(vdpaName, vdpaNetdevWaitTime)
+	if err != nil {
+		deleteVdpaDev(vdpaName)
+		return "", err
+	}
+	return netdevName, nil
+}
+
+func deleteVdpaDev(vdpaName string) error {
+	return runCommand("vdpa", "dev", "del", vdpaName)
+}
+
+func (nw *vdpaNetwork) CreateNetwork(d *driver, genNw *genericNetwork,
+	nid string, options map[string]string,
+	ipv4Data *network.IPAMData) error {
+
+	if !dirExists(vdpaBusDir) {
+		err := runCommand("modprobe", "vdpa")
+		if err != nil {
+			return fmt.Errorf("vdpa is not supported by the kernel: %v", err)
+		}
+	}
+	return nw.sriovNetwork.CreateNetwork(d, genNw, nid, options, ipv4Data)
+}
+
+func (nw *vdpaNetwork) CreateEndpoint(r *network.CreateEndpointRequest) (*network.CreateEndpointResponse, error) {
+
+	resp, err := nw.sriovNetwork.CreateEndpoint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := nw.genNw.ndevEndpoints[r.EndpointID]
+	hwAddr := r.Interface.MacAddress
+	if hwAddr == "" {
+		hwAddr, _ = GetVFDefaultMacAddr(endpoint.devName)
+	}
+
+	vdpaName := vdpaDevName(r.EndpointID)
+	netdevName, err := createVdpaDev(vdpaName, endpoint.vfObj.PciAddress, hwAddr)
+	if err != nil {
+		nw.sriovNetwork.DeleteEndpoint(endpoint)
+		delete(nw.genNw.ndevEndpoints, r.EndpointID)
+		return nil, fmt.Errorf("Fail to create vdpa device err = %v", err)
+	}
+
+	log.Printf("vdpa device %s vf: %s netdev: %s\n", vdpaName, endpoint.vfObj.PciAddress, netdevName)
+	endpoint.devName = netdevName
+	endpoint.vdpaName = vdpaName
+	return resp, nil
+}
+
+func (nw *vdpaNetwork) DeleteEndpoint(endpoint *ptEndpoint) {
+
+	if endpoint.vdpaName != "" {
+		err := deleteVdpaDev(endpoint.vdpaName)
+		if err != nil {
+			log.Printf("Fail to delete vdpa device %s: %v\n", endpoint.vdpaName, err)
+		}
+	}
+	nw.sriovNetwork.DeleteEndpoint(endpoint)
+}
+
+// RestoreEndpoint takes over a VF and its vdpa device created before the
+// plugin restarted.
+func (nw *vdpaNetwork) RestoreEndpoint(id string, dbEp *DB_Endpoint) error {
+
+	if !dirExists(filepath.Join(vdpaDevicesDir, dbEp.VdpaName)) {
+		return fmt.Errorf("vdpa device %s not found", dbEp.VdpaName)
+	}
+	err := nw.sriovNetwork.RestoreEndpoint(id, dbEp)
+	if err != nil {
+		return err
+	}
+	nw.genNw.ndevEndpoints[id].vdpaName = dbEp.VdpaName
+	return nil
+}
@@ -0,0 +1,160 @@
+package driver
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	vfPolicyLowestIndex = "lowest-index"
+	vfPolicyRoundRobin  = "round-robin"
+	vfPolicyLRU         = "least-recently-used"
+	vfPolicyRandom      = "random"
+)
+
+var vfPolicies = []string{
+	vfPolicyLowestIndex, vfPolicyRoundRobin, vfPolicyLRU, vfPolicyRandom,
+}
+
+// vfAllocator picks the VF of a new endpoint among the free VFs of a PF.
+type vfAllocator interface {
+	// pick returns the position in free of the chosen VF index.
+	pick(pfNetdevName string, free []int) int
+	// restore accounts a VF of an endpoint restored after a plugin
+	// restart.
+	restore(pfNetdevName string, index int)
+}
+
+// vfReleaseTimes records when VFs were last freed, for all networks of a
+// PF.
+// key = PF netdevice
+// value = VF index to release time
+var vfReleaseTimes = make(map[string]map[int]time.Time)
+
+func recordVfRelease(pfNetdevName string, index int) {
+	times := vfReleaseTimes[pfNetdevName]
+	if times == nil {
+		times = make(map[int]time.Time)
+		vfReleaseTimes[pfNetdevName] = times
+	}
+	times[index] = time.Now()
+}
+
+type lowestIndexAllocator struct{}
+
+func (a *lowestIndexAllocator) pick(pfNetdevName string, free []int) int {
+	pos := 0
+	for i, index := range free {
+		if index < free[pos] {
+			pos = i
+		}
+	}
+	return pos
+}
+
+func (a *lowestIndexAllocator) restore(pfNetdevName string, index int) {}
+
+// roundRobinAllocator picks the VF following the last one it picked, so
+// that VFs are used in turns.
+type roundRobinAllocator struct {
+	last int
+}
+
+func (a *roundRobinAllocator) pick(pfNetdevName string, free []int) int {
+	next := -1
+	lowest := 0
+	for i, index := range free {
+		if index > a.last && (next < 0 || index < free[next]) {
+			next = i
+		}
+		if index < free[lowest] {
+			lowest = i
+		}
+	}
+	if next < 0 {
+		next = lowest
+	}
+	a.last = free[next]
+	return next
+}
+
+// restore continues the turns after the highest VF index in use, as the
+// order of the VFs picked before the restart is not stored.
+func (a *roundRobinAllocator) restore(pfNetdevName string, index int) {
+	if index > a.last {
+		a.last = index
+	}
+}
+
+// lruAllocator picks the VF freed the longest time ago, which lets switch
+// ARP and FDB entries of its MAC address age out. VFs never freed come
+// first.
+type lruAllocator struct{}
+
+func (a *lruAllocator) pick(pfNetdevName string, free []int) int {
+	times := vfReleaseTimes[pfNetdevName]
+
+	pos := 0
+	for i, index := range free {
+		if times[index].Before(times[free[pos]]) ||
+			(times[index].Equal(times[free[pos]]) && index < free[pos]) {
+			pos = i
+		}
+	}
+	return pos
+}
+
+func (a *lruAllocator) restore(pfNetdevName string, index int) {}
+
+// randomAllocator has its own seeded source, the global one of math/rand
+// gives the same sequence on every plugin start.
+type randomAllocator struct {
+	rand *rand.Rand
+}
+
+func (a *randomAllocator) pick(pfNetdevName string, free []int) int {
+	return a.rand.Intn(len(free))
+}
+
+func (a *randomAllocator) restore(pfNetdevName string, index int) {}
+
+func newVfAllocator(policy string) (vfAllocator, error) {
+	switch policy {
+	case "", vfPolicyLowestIndex:
+		return &lowestIndexAllocator{}, nil
+	case vfPolicyRoundRobin:
+		return &roundRobinAllocator{last: -1}, nil
+	case vfPolicyLRU:
+		return &lruAllocator{}, nil
+	case vfPolicyRandom:
+		return &randomAllocator{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}, nil
+	}
+	return nil, fmt.Errorf("valid vf_policy values are: %s", strings.Join(vfPolicies, ", "))
+}
+
+// vfIndexOfNetdev returns the VF index of a VF netdevice of the PF.
+func vfIndexOfNetdev(pfNetdevName string, vfNetdevName string) (int, error) {
+	vfDir, err := FindVFDirForNetdev(pfNetdevName, vfNetdevName)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(strings.TrimPrefix(vfDir, netDevVFDevicePrefix))
+}
+
+// freeVfIndices returns the indices of the VFs of the PF which are not
+// allocated, sorted.
+func freeVfIndices(dev *pfDevice) []int {
+	var free []int
+
+	for _, vf := range dev.pfHandle.List {
+		if !vf.Allocated {
+			free = append(free, vf.Index)
+		}
+	}
+	sort.Ints(free)
+	return free
+}
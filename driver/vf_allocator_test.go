@@ -0,0 +1,170 @@
+package driver
+
+import (
+	"testing"
+	"time"
+)
+
+const testAllocPf = "enp3s0f0"
+
+// pickIndices runs the allocator on the free list for each pick, removing
+// the picked VF from the list, and returns the picked VF indices.
+func pickIndices(a vfAllocator, free []int, picks int) []int {
+	var picked []int
+
+	free = append([]int(nil), free...)
+	for i := 0; i < picks && len(free) > 0; i++ {
+		pos := a.pick(testAllocPf, free)
+		picked = append(picked, free[pos])
+		free = append(free[:pos], free[pos+1:]...)
+	}
+	return picked
+}
+
+func TestNewVfAllocator(t *testing.T) {
+	tests := []struct {
+		policy string
+		valid  bool
+	}{
+		{"", true},
+		{vfPolicyLowestIndex, true},
+		{vfPolicyRoundRobin, true},
+		{vfPolicyLRU, true},
+		{vfPolicyRandom, true},
+		{"fifo", false},
+		{"Random", false},
+	}
+	for _, test := range tests {
+		a, err := newVfAllocator(test.policy)
+		if test.valid && (err != nil || a == nil) {
+			t.Errorf("policy %q: %v", test.policy, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("policy %q accepted", test.policy)
+		}
+	}
+}
+
+func TestVfAllocatorPolicies(t *testing.T) {
+	tests := []struct {
+		policy   string
+		free     []int
+		picks    int
+		expected []int
+	}{
+		{vfPolicyLowestIndex, []int{5, 2, 7, 0}, 4, []int{0, 2, 5, 7}},
+		{vfPolicyLowestIndex, []int{3}, 1, []int{3}},
+		{vfPolicyRoundRobin, []int{0, 1, 2, 3}, 4, []int{0, 1, 2, 3}},
+		{vfPolicyRoundRobin, []int{6, 1, 4}, 3, []int{1, 4, 6}},
+	}
+	for _, test := range tests {
+		a, err := newVfAllocator(test.policy)
+		if err != nil {
+			t.Fatalf("policy %s: %v", test.policy, err)
+		}
+		picked := pickIndices(a, test.free, test.picks)
+		if !sameInts(picked, test.expected) {
+			t.Errorf("policy %s free %v: picked %v, expected %v",
+				test.policy, test.free, picked, test.expected)
+		}
+	}
+}
+
+func TestRoundRobinAllocatorWraps(t *testing.T) {
+	tests := []struct {
+		last     int
+		free     []int
+		expected int
+	}{
+		{-1, []int{0, 1, 2}, 0},
+		{0, []int{0, 1, 2}, 1},
+		{1, []int{0, 3}, 3},
+		{2, []int{0, 1, 2}, 0},
+		{7, []int{2, 5}, 2},
+	}
+	for _, test := range tests {
+		a := &roundRobinAllocator{last: test.last}
+		pos := a.pick(testAllocPf, test.free)
+		if test.free[pos] != test.expected {
+			t.Errorf("last %d free %v: picked %d, expected %d",
+				test.last, test.free, test.free[pos], test.expected)
+		}
+		if a.last != test.expected {
+			t.Errorf("last %d free %v: last is %d after pick", test.last, test.free, a.last)
+		}
+	}
+}
+
+func TestRoundRobinAllocatorRestore(t *testing.T) {
+	a := &roundRobinAllocator{last: -1}
+	for _, index := range []int{4, 1, 2} {
+		a.restore(testAllocPf, index)
+	}
+	pos := a.pick(testAllocPf, []int{0, 3, 5, 6})
+	if a.last != 5 || pos != 2 {
+		t.Errorf("picked position %d VF %d after restore, expected VF 5", pos, a.last)
+	}
+}
+
+func TestLruAllocator(t *testing.T) {
+	prevTimes := vfReleaseTimes
+	defer func() { vfReleaseTimes = prevTimes }()
+
+	now := time.Now()
+	tests := []struct {
+		released map[int]time.Time
+		free     []int
+		expected int
+	}{
+		{nil, []int{3, 1, 2}, 1},
+		{map[int]time.Time{1: now, 2: now.Add(-time.Minute)}, []int{1, 2, 3}, 3},
+		{map[int]time.Time{1: now, 2: now.Add(-time.Minute)}, []int{1, 2}, 2},
+		{map[int]time.Time{1: now, 2: now}, []int{2, 1}, 1},
+	}
+	for _, test := range tests {
+		vfReleaseTimes = map[string]map[int]time.Time{testAllocPf: test.released}
+		a := &lruAllocator{}
+		pos := a.pick(testAllocPf, test.free)
+		if test.free[pos] != test.expected {
+			t.Errorf("released %v free %v: picked %d, expected %d",
+				test.released, test.free, test.free[pos], test.expected)
+		}
+	}
+}
+
+func TestRecordVfRelease(t *testing.T) {
+	prevTimes := vfReleaseTimes
+	defer func() { vfReleaseTimes = prevTimes }()
+	vfReleaseTimes = make(map[string]map[int]time.Time)
+
+	recordVfRelease(testAllocPf, 0)
+	recordVfRelease(testAllocPf, 1)
+	a := &lruAllocator{}
+	pos := a.pick(testAllocPf, []int{0, 1, 2})
+	if pos != 2 {
+		t.Errorf("picked position %d, expected the VF never freed", pos)
+	}
+	pos = a.pick(testAllocPf, []int{0, 1})
+	if pos != 0 {
+		t.Errorf("picked position %d, expected the VF freed first", pos)
+	}
+}
+
+func TestRandomAllocatorInRange(t *testing.T) {
+	a, err := newVfAllocator(vfPolicyRandom)
+	if err != nil {
+		t.Fatalf("random policy: %v", err)
+	}
+	free := []int{4, 9, 11}
+	seen := make(map[int]bool)
+	for i := 0; i < 200; i++ {
+		pos := a.pick(testAllocPf, free)
+		if pos < 0 || pos >= len(free) {
+			t.Fatalf("picked position %d of %d free VFs", pos, len(free))
+		}
+		seen[pos] = true
+	}
+	if len(seen) != len(free) {
+		t.Errorf("picked positions %v of %d free VFs in 200 picks", seen, len(free))
+	}
+}
@@ -0,0 +1,204 @@
+package driver
+
+import (
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"io"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	denyVfPrefix = "vf"
+)
+
+// vfDenyList lists the VFs which the plugin never hands out, such as VFs
+// used by VMs or by the host itself. Entries are vfN, MAC or PCI addresses.
+type vfDenyList struct {
+	indices  map[int]bool
+	macs     map[string]bool
+	pciAddrs map[string]bool
+}
+
+func parseVfDenyList(entryLists ...[]string) (*vfDenyList, error) {
+	deny := &vfDenyList{
+		indices:  make(map[int]bool),
+		macs:     make(map[string]bool),
+		pciAddrs: make(map[string]bool),
+	}
+	for _, entries := range entryLists {
+		for _, entry := range entries {
+			entry = strings.TrimSpace(entry)
+			if strings.HasPrefix(entry, denyVfPrefix) {
+				index, err := strconv.Atoi(strings.TrimPrefix(entry, denyVfPrefix))
+				if err != nil || index < 0 {
+					return nil, fmt.Errorf("Invalid denied vf %s", entry)
+				}
+				deny.indices[index] = true
+			} else if mac, err := net.ParseMAC(entry); err == nil {
+				deny.macs[mac.String()] = true
+			} else if strings.Count(entry, ":") == 2 && strings.Contains(entry, ".") {
+				deny.pciAddrs[strings.ToLower(entry)] = true
+			} else {
+				return nil, fmt.Errorf("Invalid denied vf %s, expected vfN, mac or PCI address", entry)
+			}
+		}
+	}
+	return deny, nil
+}
+
+func (deny *vfDenyList) isEmpty() bool {
+	return deny == nil ||
+		(len(deny.indices) == 0 && len(deny.macs) == 0 && len(deny.pciAddrs) == 0)
+}
+
+// vfDenyList returns the VFs of the PF denied in the daemon configuration,
+// both for all PFs and for the PF itself.
+func (config *Daemon_Config) vfDenyList(pfNetdevName string) (*vfDenyList, error) {
+	if config == nil {
+		return parseVfDenyList()
+	}
+	var pfDeny []string
+	if pfCfg := config.pfConfig(pfNetdevName); pfCfg != nil {
+		pfDeny = pfCfg.DenyVfs
+	}
+	return parseVfDenyList(config.DenyVfs, pfDeny)
+}
+
+// pfVfAdminMacs returns the MAC addresses which the PF assigned to its VFs,
+// by VF index. VFs given to VMs have no netdevice in the host to read
+// their MAC address from.
+func pfVfAdminMacs(pfNetdevName string) map[int]string {
+	macs := make(map[int]string)
+
+	link, err := netlink.LinkByName(pfNetdevName)
+	if err != nil {
+		return macs
+	}
+	for _, vf := range link.Attrs().Vfs {
+		if vf.Mac != nil {
+			macs[vf.ID] = vf.Mac.String()
+		}
+	}
+	return macs
+}
+
+// vfMacs returns the MAC addresses of a VF, set by the PF and of its
+// netdevices.
+func vfMacs(pfNetdevName string, vfDir string, adminMacs map[int]string) []string {
+	var macs []string
+
+	index, err := strconv.Atoi(strings.TrimPrefix(vfDir, netDevVFDevicePrefix))
+	if err == nil && adminMacs[index] != "" {
+		macs = append(macs, adminMacs[index])
+	}
+	vfNetdevs, _ := lsDirs(filepath.Join(netSysDir, pfNetdevName, netDevPrefix, vfDir, "net"))
+	for _, vfNetdev := range vfNetdevs {
+		mac, err := GetVFDefaultMacAddr(vfNetdev)
+		if err == nil {
+			macs = append(macs, mac)
+		}
+	}
+	return macs
+}
+
+// isVfDenied tells whether the VF of the PF at the virtfnN directory is on
+// the deny list.
+func (deny *vfDenyList) isVfDenied(pfNetdevName string, vfDir string, adminMacs map[int]string) bool {
+	if deny.isEmpty() {
+		return false
+	}
+	index, err := strconv.Atoi(strings.TrimPrefix(vfDir, netDevVFDevicePrefix))
+	if err == nil && deny.indices[index] {
+		return true
+	}
+	if deny.pciAddrs[vfPCIDevNameFromVfDir(pfNetdevName, vfDir)] {
+		return true
+	}
+	for _, mac := range vfMacs(pfNetdevName, vfDir, adminMacs) {
+		if deny.macs[mac] {
+			return true
+		}
+	}
+	return false
+}
+
+// deniedVfs returns the indices of the VFs of the PF on the deny list.
+func (deny *vfDenyList) deniedVfs(pfNetdevName string) map[int]bool {
+	denied := make(map[int]bool)
+
+	if deny.isEmpty() {
+		return denied
+	}
+	vfDirs, err := GetVfPciDevList(pfNetdevName)
+	if err != nil {
+		return denied
+	}
+	adminMacs := pfVfAdminMacs(pfNetdevName)
+	for _, vfDir := range vfDirs {
+		index, err := strconv.Atoi(strings.TrimPrefix(vfDir, netDevVFDevicePrefix))
+		if err != nil {
+			continue
+		}
+		if deny.isVfDenied(pfNetdevName, vfDir, adminMacs) {
+			denied[index] = true
+		}
+	}
+	return denied
+}
+
+// reserveDeniedVfs marks the denied VFs of the PF allocated, so that
+// sriovnet never allocates them.
+func reserveDeniedVfs(dev *pfDevice) {
+	for _, vf := range dev.pfHandle.List {
+		if dev.denied[vf.Index] {
+			vf.Allocated = true
+		}
+	}
+}
+
+func sortedVfIndices(vfs map[int]bool) []int {
+	var indices []int
+
+	for index := range vfs {
+		indices = append(indices, index)
+	}
+	sort.Ints(indices)
+	return indices
+}
+
+// WriteVfInventory writes the VFs of the SRIOV PFs of the host and whether
+// they are on the deny list of the daemon configuration.
+func WriteVfInventory(configFile string, out io.Writer) error {
+	config, err := LoadDaemonConfig(configFile)
+	if err != nil {
+		return err
+	}
+	pfs, err := selectPfs(&pfSelector{port: -1, numa: -1}, true)
+	if err != nil {
+		return err
+	}
+	for _, pfNetdevName := range pfs {
+		deny, err := config.vfDenyList(pfNetdevName)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s\n", pfNetdevName)
+
+		vfDirs, _ := GetVfPciDevList(pfNetdevName)
+		adminMacs := pfVfAdminMacs(pfNetdevName)
+		for _, vfDir := range vfDirs {
+			state := "available"
+			if deny.isVfDenied(pfNetdevName, vfDir, adminMacs) {
+				state = "denied"
+			}
+			fmt.Fprintf(out, "\t%s\t%s\t%s\t%s\n", vfDir,
+				vfPCIDevNameFromVfDir(pfNetdevName, vfDir),
+				strings.Join(vfMacs(pfNetdevName, vfDir, adminMacs), ","), state)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package driver
+
+import (
+	"github.com/Mellanox/sriovnet"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// denyEntries returns the entries of a deny list in a sorted, printable
+// form.
+func denyEntries(deny *vfDenyList) string {
+	var entries []string
+
+	for index := range deny.indices {
+		entries = append(entries, denyVfPrefix+strconv.Itoa(index))
+	}
+	for mac := range deny.macs {
+		entries = append(entries, mac)
+	}
+	for pciAddr := range deny.pciAddrs {
+		entries = append(entries, pciAddr)
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+func TestParseVfDenyList(t *testing.T) {
+	tests := []struct {
+		entries  []string
+		expected string
+		valid    bool
+	}{
+		{nil, "", true},
+		{[]string{"vf0", "vf3"}, "vf0,vf3", true},
+		{[]string{" vf2 "}, "vf2", true},
+		{[]string{"02:00:00:00:00:0A"}, "02:00:00:00:00:0a", true},
+		{[]string{"0000:03:00.2"}, "0000:03:00.2", true},
+		{[]string{"0000:AF:00.7"}, "0000:af:00.7", true},
+		{[]string{"vf1", "02:00:00:00:00:01", "0000:03:00.4"},
+			"0000:03:00.4,02:00:00:00:00:01,vf1", true},
+		{[]string{"vf"}, "", false},
+		{[]string{"vf-1"}, "", false},
+		{[]string{"vfx"}, "", false},
+		{[]string{""}, "", false},
+		{[]string{"eth0"}, "", false},
+		{[]string{"0000:03:00"}, "", false},
+		{[]string{"02:00:00:00:00"}, "", false},
+	}
+	for _, test := range tests {
+		deny, err := parseVfDenyList(test.entries)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%q accepted", test.entries)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.entries, err)
+			continue
+		}
+		if denyEntries(deny) != test.expected {
+			t.Errorf("%q parsed as %s, expected %s", test.entries, denyEntries(deny), test.expected)
+		}
+		if deny.isEmpty() != (test.expected == "") {
+			t.Errorf("%q: isEmpty is %v", test.entries, deny.isEmpty())
+		}
+	}
+}
+
+func TestDaemonConfigVfDenyList(t *testing.T) {
+	config := &Daemon_Config{
+		DenyVfs: []string{"vf0"},
+		Pfs: map[string]*Daemon_Pf_Config{
+			"enp3s0f0": {DenyVfs: []string{"vf1", "0000:03:00.5"}},
+			"enp3s0f1": {DenyVfs: []string{"bad"}},
+		},
+	}
+	tests := []struct {
+		config   *Daemon_Config
+		pf       string
+		expected string
+		valid    bool
+	}{
+		{nil, "enp3s0f0", "", true},
+		{config, "enp3s0f0", "0000:03:00.5,vf0,vf1", true},
+		{config, "enp4s0f0", "vf0", true},
+		{config, "enp3s0f1", "", false},
+	}
+	for _, test := range tests {
+		deny, err := test.config.vfDenyList(test.pf)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: invalid deny list accepted", test.pf)
+			}
+			continue
+		}
+		if err != nil || denyEntries(deny) != test.expected {
+			t.Errorf("%s: deny list %s (%v), expected %s", test.pf, denyEntries(deny), err, test.expected)
+		}
+	}
+}
+
+func TestReserveDeniedVfs(t *testing.T) {
+	handle := &sriovnet.PfNetdevHandle{PfNetdevName: "enp3s0f0"}
+	for index := 0; index < 4; index++ {
+		handle.List = append(handle.List, &sriovnet.VfObj{Index: index})
+	}
+	dev := &pfDevice{pfHandle: handle, denied: map[int]bool{1: true, 3: true}}
+
+	reserveDeniedVfs(dev)
+	free := freeVfIndices(dev)
+	if !sameInts(free, []int{0, 2}) {
+		t.Errorf("free VFs %v, expected the denied VFs allocated", free)
+	}
+}
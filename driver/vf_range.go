@@ -0,0 +1,160 @@
+package driver
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// vfPartition is the share of the VFs of its PF which a network may use.
+// Networks with a VF range use only the VFs of their range, other networks
+// of the PF share the VFs which are in no range.
+type vfPartition struct {
+	vfs     []int // VF indices of the network, nil for the shared VFs
+	reserve int   // VFs kept free for the network
+}
+
+func parseVfPartition(options map[string]string) (*vfPartition, error) {
+	var err error
+
+	part := &vfPartition{}
+	if options[networkVfs] != "" {
+		vfs, err := parseIndexList(options[networkVfs])
+		if err != nil || len(vfs) == 0 {
+			return nil, fmt.Errorf("Invalid vfs %s, valid format is such as 0-15,20", options[networkVfs])
+		}
+		for _, index := range vfs {
+			if !containsInt(part.vfs, index) {
+				part.vfs = append(part.vfs, index)
+			}
+		}
+		sort.Ints(part.vfs)
+	}
+	if options[networkReserve] != "" {
+		part.reserve, err = strconv.Atoi(options[networkReserve])
+		if err != nil || part.reserve < 0 {
+			return nil, fmt.Errorf("Invalid reserve %s", options[networkReserve])
+		}
+	}
+	return part, nil
+}
+
+func parseMaxEndpoints(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	max, err := strconv.Atoi(value)
+	if err != nil || max <= 0 {
+		return 0, fmt.Errorf("Invalid max_endpoints %s", value)
+	}
+	return max, nil
+}
+
+// pfNetworks returns the other sriov networks of the PF.
+func (nw *sriovNetwork) pfNetworks() []*sriovNetwork {
+	var pfNws []*sriovNetwork
+
+	for _, cur := range networks {
+		if cur != nw && cur.genNw.ndevName == nw.genNw.ndevName {
+			pfNws = append(pfNws, cur)
+		}
+	}
+	return pfNws
+}
+
+// inVfPool tells whether the network may use the VF.
+func (nw *sriovNetwork) inVfPool(index int) bool {
+	if nw.partition.vfs != nil {
+		return containsInt(nw.partition.vfs, index)
+	}
+	for _, cur := range nw.pfNetworks() {
+		if containsInt(cur.partition.vfs, index) {
+			return false
+		}
+	}
+	return true
+}
+
+// pendingReserve returns the number of shared VFs which are kept free for
+// the reservations of other networks of the PF.
+func (nw *sriovNetwork) pendingReserve() int {
+	pending := 0
+	for _, cur := range nw.pfNetworks() {
+		if cur.partition.vfs != nil {
+			continue
+		}
+		left := cur.partition.reserve - len(cur.genNw.ndevEndpoints)
+		if left > 0 {
+			pending += left
+		}
+	}
+	return pending
+}
+
+// checkVfPartition checks that the VF range and reservation of the network
+// fit the PF along with those of the other networks of the PF.
+func (nw *sriovNetwork) checkVfPartition(dev *pfDevice) error {
+	numVfs := len(dev.pfHandle.List)
+	part := nw.partition
+
+	allocated := make(map[int]bool)
+	for _, vf := range dev.pfHandle.List {
+		allocated[vf.Index] = vf.Allocated
+	}
+	for _, index := range part.vfs {
+		if _, ok := allocated[index]; !ok {
+			return fmt.Errorf("vf %d not found on %s, which has %d VFs", index, nw.genNw.ndevName, numVfs)
+		}
+		if dev.denied[index] {
+			return fmt.Errorf("vf %d of %s is on the deny list", index, nw.genNw.ndevName)
+		}
+		if allocated[index] {
+			return fmt.Errorf("vf %d of %s is in use by another network", index, nw.genNw.ndevName)
+		}
+	}
+	if part.vfs != nil && part.reserve > len(part.vfs) {
+		return fmt.Errorf("reserve %d exceeds the %d VFs of the network", part.reserve, len(part.vfs))
+	}
+
+	shared := numVfs - len(part.vfs) - len(dev.denied)
+	sharedReserve := 0
+	if part.vfs == nil {
+		sharedReserve = part.reserve
+	}
+	for _, cur := range nw.pfNetworks() {
+		for _, index := range part.vfs {
+			if containsInt(cur.partition.vfs, index) {
+				return fmt.Errorf("vf %d of %s is in the vfs of network %s", index, nw.genNw.ndevName, cur.genNw.id)
+			}
+		}
+		if cur.partition.vfs != nil {
+			shared -= len(cur.partition.vfs)
+		} else {
+			sharedReserve += cur.partition.reserve
+		}
+	}
+	if sharedReserve > shared {
+		return fmt.Errorf("reservations of networks of %s need %d VFs, only %d VFs are in no network vfs",
+			nw.genNw.ndevName, sharedReserve, shared)
+	}
+	return nil
+}
+
+// freePoolVfs returns the free VFs which the network may allocate, keeping
+// the VFs reserved for other networks.
+func (nw *sriovNetwork) freePoolVfs(dev *pfDevice) ([]int, error) {
+	var free []int
+
+	for _, index := range freeVfIndices(dev) {
+		if nw.inVfPool(index) {
+			free = append(free, index)
+		}
+	}
+	if len(free) == 0 {
+		return nil, fmt.Errorf("All Vfs for %v are allocated.", nw.genNw.ndevName)
+	}
+	if nw.partition.vfs == nil && len(free) <= nw.pendingReserve() {
+		return nil, fmt.Errorf("free VFs of %v are reserved for other networks", nw.genNw.ndevName)
+	}
+	return free, nil
+}
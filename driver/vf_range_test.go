@@ -0,0 +1,173 @@
+package driver
+
+import (
+	"github.com/Mellanox/sriovnet"
+	"strconv"
+	"testing"
+)
+
+const testRangePf = "enp3s0f0"
+
+func TestParseVfPartition(t *testing.T) {
+	tests := []struct {
+		vfs      string
+		reserve  string
+		expected []int
+		nReserve int
+		valid    bool
+	}{
+		{"", "", nil, 0, true},
+		{"0-3", "", []int{0, 1, 2, 3}, 0, true},
+		{"4,0-2,1", "2", []int{0, 1, 2, 4}, 2, true},
+		{"", "3", nil, 3, true},
+		{"3-0", "", nil, 0, false},
+		{"x", "", nil, 0, false},
+		{"0-3", "-1", nil, 0, false},
+		{"0-3", "two", nil, 0, false},
+	}
+	for _, test := range tests {
+		options := map[string]string{networkVfs: test.vfs, networkReserve: test.reserve}
+		part, err := parseVfPartition(options)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("vfs %q reserve %q accepted", test.vfs, test.reserve)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("vfs %q reserve %q: %v", test.vfs, test.reserve, err)
+			continue
+		}
+		if !sameInts(part.vfs, test.expected) || part.reserve != test.nReserve {
+			t.Errorf("vfs %q reserve %q parsed as %v reserve %d", test.vfs, test.reserve,
+				part.vfs, part.reserve)
+		}
+	}
+}
+
+// setupVfRangeTest returns a PF device with numVfs VFs, the allocated and
+// denied ones as given, and installs the other networks of the PF, with a
+// function restoring the networks.
+func setupVfRangeTest(numVfs int, allocated []int, denied []int,
+	others ...*vfPartition) (*pfDevice, func()) {
+	handle := &sriovnet.PfNetdevHandle{PfNetdevName: testRangePf}
+	for index := 0; index < numVfs; index++ {
+		handle.List = append(handle.List, &sriovnet.VfObj{
+			Index:     index,
+			Allocated: containsInt(allocated, index),
+		})
+	}
+	dev := &pfDevice{pfHandle: handle, denied: make(map[int]bool)}
+	for _, index := range denied {
+		dev.denied[index] = true
+	}
+
+	prevNetworks := networks
+	networks = make(map[string]*sriovNetwork)
+	for i, part := range others {
+		id := "nw" + strconv.Itoa(i)
+		networks[id] = &sriovNetwork{
+			genNw:     createGenNw(id, testRangePf, "sriov", "", nil),
+			partition: part,
+		}
+	}
+	return dev, func() { networks = prevNetworks }
+}
+
+func TestCheckVfPartition(t *testing.T) {
+	tests := []struct {
+		name      string
+		numVfs    int
+		allocated []int
+		denied    []int
+		others    []*vfPartition
+		part      *vfPartition
+		valid     bool
+	}{
+		{"no partition", 8, nil, nil, nil, &vfPartition{}, true},
+		{"range", 8, nil, nil, nil, &vfPartition{vfs: []int{0, 1}}, true},
+		{"range beyond VFs", 4, nil, nil, nil, &vfPartition{vfs: []int{3, 4}}, false},
+		{"range on denied VF", 8, nil, []int{1}, nil, &vfPartition{vfs: []int{0, 1}}, false},
+		{"range on allocated VF", 8, []int{1}, nil, nil, &vfPartition{vfs: []int{0, 1}}, false},
+		{"reserve beyond range", 8, nil, nil, nil, &vfPartition{vfs: []int{0, 1}, reserve: 3}, false},
+		{"reserve within range", 8, nil, nil, nil, &vfPartition{vfs: []int{0, 1}, reserve: 2}, true},
+		{"overlapping ranges", 8, nil, nil,
+			[]*vfPartition{{vfs: []int{2, 3}}},
+			&vfPartition{vfs: []int{3, 4}}, false},
+		{"disjoint ranges", 8, nil, nil,
+			[]*vfPartition{{vfs: []int{2, 3}}},
+			&vfPartition{vfs: []int{4, 5}}, true},
+		{"reserve of shared VFs", 8, nil, nil,
+			[]*vfPartition{{vfs: []int{0, 1, 2, 3}}},
+			&vfPartition{reserve: 4}, true},
+		{"reserve beyond shared VFs", 8, nil, nil,
+			[]*vfPartition{{vfs: []int{0, 1, 2, 3}}},
+			&vfPartition{reserve: 5}, false},
+		{"reserves beyond shared VFs", 8, nil, nil,
+			[]*vfPartition{{reserve: 3}},
+			&vfPartition{reserve: 6}, false},
+		{"range leaving too few shared VFs", 8, nil, nil,
+			[]*vfPartition{{reserve: 6}},
+			&vfPartition{vfs: []int{0, 1, 2}}, false},
+		{"denied VFs are not shared", 8, nil, []int{6, 7},
+			[]*vfPartition{{reserve: 4}},
+			&vfPartition{reserve: 3}, false},
+	}
+	for _, test := range tests {
+		dev, restore := setupVfRangeTest(test.numVfs, test.allocated, test.denied, test.others...)
+		nw := &sriovNetwork{
+			genNw:     createGenNw("nw", testRangePf, "sriov", "", nil),
+			partition: test.part,
+		}
+		err := nw.checkVfPartition(dev)
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: accepted", test.name)
+		}
+		restore()
+	}
+}
+
+func TestFreePoolVfs(t *testing.T) {
+	tests := []struct {
+		name      string
+		allocated []int
+		others    []*vfPartition
+		part      *vfPartition
+		expected  []int
+	}{
+		{"shared", []int{1}, nil, &vfPartition{}, []int{0, 2, 3, 4, 5}},
+		{"range", []int{1}, nil, &vfPartition{vfs: []int{1, 2, 3}}, []int{2, 3}},
+		{"shared without ranges", nil,
+			[]*vfPartition{{vfs: []int{0, 1}}},
+			&vfPartition{}, []int{2, 3, 4, 5}},
+		{"shared above reservations", nil,
+			[]*vfPartition{{vfs: []int{0, 1}}, {reserve: 3}},
+			&vfPartition{}, []int{2, 3, 4, 5}},
+		{"shared kept for reservations", []int{2, 3, 4},
+			[]*vfPartition{{reserve: 3}},
+			&vfPartition{}, nil},
+		{"range ignores reservations", nil,
+			[]*vfPartition{{reserve: 6}},
+			&vfPartition{vfs: []int{0}}, []int{0}},
+		{"range used up", []int{0}, nil, &vfPartition{vfs: []int{0}}, nil},
+	}
+	for _, test := range tests {
+		dev, restore := setupVfRangeTest(6, test.allocated, nil, test.others...)
+		nw := &sriovNetwork{
+			genNw:     createGenNw("nw", testRangePf, "sriov", "", nil),
+			partition: test.part,
+		}
+		free, err := nw.freePoolVfs(dev)
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("%s: free VFs %v, expected none", test.name, free)
+			}
+		} else if err != nil || !sameInts(free, test.expected) {
+			t.Errorf("%s: free VFs %v (%v), expected %v", test.name, free, err, test.expected)
+		}
+		restore()
+	}
+}
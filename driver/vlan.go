@@ -0,0 +1,215 @@
+package driver
+
+import (
+	"fmt"
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/vishvananda/netlink"
+	"log"
+	"net"
+	"strconv"
+)
+
+const (
+	macvlanPrefix = "mv"
+	macvlanIDLen  = 12
+	vlanDevAlias  = "docker-sriov-plugin:" // alias of VLAN devices created by plugin
+	vlanDevPrefix = "vl"                   // VLAN devices of PFs with long names
+
+	ifNameMaxLen = 15 // IFNAMSIZ without the terminating nul
+)
+
+// vlanNetwork gives each container a macvlan device on top of an 802.1Q
+// device of the PF, shared by the network, for hosts without SR-IOV.
+type vlanNetwork struct {
+	genNw   *genericNetwork
+	vlan    int
+	vlanDev string // parent of macvlan devices, PF when vlan is 0
+}
+
+func checkVlanModeNwExist(d *driver, pfNetdevName string, vlan int) bool {
+	if vlan == 0 {
+		return false
+	}
+
+	for _, nw := range d.networks {
+		vlanNw, ok := nw.(*vlanNetwork)
+		if ok && vlanNw.vlan == vlan && vlanNw.genNw.ndevName == pfNetdevName {
+			return true
+		}
+	}
+	return false
+}
+
+func macvlanName(endpointID string) string {
+	if len(endpointID) > macvlanIDLen {
+		endpointID = endpointID[:macvlanIDLen]
+	}
+	return macvlanPrefix + endpointID
+}
+
+func (nw *vlanNetwork) getGenNw() *genericNetwork {
+	return nw.genNw
+}
+
+// pfVlanDevName returns the name of the 802.1Q device of a PF, <pf>.<vlan>
+// unless it is longer than the kernel allows, as with enp129s0f0np0.1000.
+// Such PFs get a name made of their ifindex, which stays the same across
+// plugin restarts.
+func pfVlanDevName(parent netlink.Link, vlan int) string {
+	name := fmt.Sprintf("%s.%d", parent.Attrs().Name, vlan)
+	if len(name) <= ifNameMaxLen {
+		return name
+	}
+	return fmt.Sprintf("%s%d.%d", vlanDevPrefix, parent.Attrs().Index, vlan)
+}
+
+// createVlanDev creates the 802.1Q device of the network, or reuses the
+// one already configured on the host.
+func (nw *vlanNetwork) createVlanDev(nid string) error {
+	parent, err := netlink.LinkByName(nw.genNw.ndevName)
+	if err != nil {
+		return err
+	}
+	vlanDevName := pfVlanDevName(parent, nw.vlan)
+
+	link, err := netlink.LinkByName(vlanDevName)
+	if err != nil {
+		vlanLink := &netlink.Vlan{
+			LinkAttrs: netlink.NewLinkAttrs(),
+			VlanId:    nw.vlan,
+		}
+		vlanLink.Name = vlanDevName
+		vlanLink.ParentIndex = parent.Attrs().Index
+		err = netlink.LinkAdd(vlanLink)
+		if err != nil {
+			return fmt.Errorf("Fail to create vlan device %s: %v", vlanDevName, err)
+		}
+		link = vlanLink
+		// alias marks the device as owned by the network, so that it is
+		// deleted with the network even after plugin restart.
+		err = netlink.LinkSetAlias(link, vlanDevAlias+nid)
+		if err != nil {
+			netlink.LinkDel(link)
+			return err
+		}
+		log.Printf("Created vlan device %s\n", vlanDevName)
+	}
+	nw.vlanDev = vlanDevName
+	return netlink.LinkSetUp(link)
+}
+
+func (nw *vlanNetwork) CreateNetwork(d *driver, genNw *genericNetwork,
+	nid string, options map[string]string,
+	ipv4Data *network.IPAMData) error {
+	var err error
+	var vlan int
+
+	ndevName := options[networkDevice]
+
+	if options[sriovVlan] != "" {
+		vlan, _ = strconv.Atoi(options[sriovVlan])
+		if vlan < 0 || vlan > 4095 {
+			return fmt.Errorf("Invalid vlan id given")
+		}
+	}
+	if checkVlanModeNwExist(d, ndevName, vlan) {
+		return fmt.Errorf("vlan already exist")
+	}
+	nw.vlan = vlan
+	nw.genNw = genNw
+
+	err = SetPFLinkUp(ndevName)
+	if err != nil {
+		return err
+	}
+
+	nw.vlanDev = ndevName
+	if nw.vlan > 0 {
+		err = nw.createVlanDev(nid)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("VLAN CreateNetwork : [%s] vlan: %d IPv4Data : [ %+v ]\n",
+		nw.genNw.id, nw.vlan, nw.genNw.IPv4Data)
+	return nil
+}
+
+func (nw *vlanNetwork) DeleteNetwork(d *driver, req *network.DeleteNetworkRequest) {
+	if nw.vlanDev == nw.genNw.ndevName {
+		return
+	}
+
+	link, err := netlink.LinkByName(nw.vlanDev)
+	if err != nil || link.Attrs().Alias != vlanDevAlias+req.NetworkID {
+		/* vlan device configured outside of plugin */
+		return
+	}
+	err = netlink.LinkDel(link)
+	if err != nil {
+		log.Printf("Fail to delete vlan device %s: %v\n", nw.vlanDev, err)
+	}
+}
+
+func (nw *vlanNetwork) CreateEndpoint(r *network.CreateEndpointRequest) (*network.CreateEndpointResponse, error) {
+
+	parent, err := netlink.LinkByName(nw.vlanDev)
+	if err != nil {
+		return nil, err
+	}
+
+	macvlan := &netlink.Macvlan{
+		LinkAttrs: netlink.NewLinkAttrs(),
+		Mode:      netlink.MACVLAN_MODE_BRIDGE,
+	}
+	macvlan.Name = macvlanName(r.EndpointID)
+	macvlan.ParentIndex = parent.Attrs().Index
+	if r.Interface.MacAddress != "" {
+		macvlan.HardwareAddr, err = net.ParseMAC(r.Interface.MacAddress)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = netlink.LinkAdd(macvlan)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to create macvlan %s: %v", macvlan.Name, err)
+	}
+
+	ndev := &ptEndpoint{
+		devName: macvlan.Name,
+		Address: r.Interface.Address,
+	}
+	nw.genNw.ndevEndpoints[r.EndpointID] = ndev
+
+	resp := &network.CreateEndpointResponse{Interface: &network.EndpointInterface{}}
+	log.Printf("VLAN CreateEndpoint %s parent: %s\n", macvlan.Name, nw.vlanDev)
+	return resp, nil
+}
+
+func (nw *vlanNetwork) DeleteEndpoint(endpoint *ptEndpoint) {
+
+	link, err := netlink.LinkByName(endpoint.devName)
+	if err == nil {
+		err = netlink.LinkDel(link)
+	}
+	if err != nil {
+		log.Printf("Fail to delete macvlan %s: %v\n", endpoint.devName, err)
+	}
+}
+
+// RestoreEndpoint takes over a macvlan device created before the plugin
+// restarted.
+func (nw *vlanNetwork) RestoreEndpoint(id string, dbEp *DB_Endpoint) error {
+
+	_, err := netlink.LinkByName(dbEp.DevName)
+	if err != nil {
+		return err
+	}
+	nw.genNw.ndevEndpoints[id] = &ptEndpoint{
+		devName: dbEp.DevName,
+		Address: dbEp.Address,
+	}
+	return nil
+}
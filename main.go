@@ -2,7 +2,6 @@ package main
 
 import (
 	"github.com/codegangsta/cli"
-	"github.com/docker/go-plugins-helpers/network"
 	"log"
 	"os"
 
@@ -15,11 +14,11 @@ const (
 
 // Run initializes the driver
 func Run(ctx *cli.Context) {
-	d, err := driver.StartDriver()
+	d, err := driver.StartDriver(ctx.String("config"))
 	if err != nil {
 		panic(err)
 	}
-	h := network.NewHandler(d)
+	h := driver.NewHandler(d)
 
 	log.Printf("Mellanox sriov plugin started version=%v\n", version)
 	log.Printf("Ready to accept commands.\n")
@@ -31,18 +30,54 @@ func Run(ctx *cli.Context) {
 	}
 }
 
+// RunOciHook runs the OCI prestart hook which adds RDMA devices to containers
+func RunOciHook(ctx *cli.Context) {
+	err := driver.RunOciHook(os.Stdin)
+	if err != nil {
+		log.Printf("oci hook error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// RunInventory prints the VFs of the host and the VFs denied to containers
+func RunInventory(ctx *cli.Context) {
+	err := driver.WriteVfInventory(ctx.GlobalString("config"), os.Stdout)
+	if err != nil {
+		log.Printf("inventory error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
 func main() {
 
 	var flagDebug = cli.BoolFlag{
 		Name:  "debug, d",
 		Usage: "enable debugging",
 	}
+	var flagConfig = cli.StringFlag{
+		Name:  "config, c",
+		Value: driver.DefaultConfigFile,
+		Usage: "daemon configuration file",
+	}
 	app := cli.NewApp()
 	app.Name = "sriov"
 	app.Usage = "Docker Networking using SRIOV/Passthrough netdevices"
 	app.Version = version
 	app.Flags = []cli.Flag{
 		flagDebug,
+		flagConfig,
+	}
+	app.Commands = []cli.Command{
+		{
+			Name:   "oci-hook",
+			Usage:  "OCI prestart hook adding RDMA devices of the container VFs",
+			Action: RunOciHook,
+		},
+		{
+			Name:   "inventory",
+			Usage:  "list VFs of the SRIOV PFs and whether they are denied to containers",
+			Action: RunInventory,
+		},
 	}
 	app.Action = Run
 	app.Run(os.Args)